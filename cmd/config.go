@@ -0,0 +1,453 @@
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LBF38/proxycache/proxycache"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the routing configuration read from the --config file.
+type Config struct {
+	Services map[string]ServiceConfig `yaml:"services"`
+	Routes   []RouteConfig            `yaml:"routes"`
+	TCP      []TCPConfig              `yaml:"tcp"`
+	UDP      []UDPConfig              `yaml:"udp"`
+	TLS      *TLSConfig               `yaml:"tls"`
+}
+
+// TLSConfig is the TLS policy of the --tls-port listener, overriding the
+// flags when set, and its certificates, served after the --tls-cert one.
+type TLSConfig struct {
+	Certificates []CertificateConfig `yaml:"certificates"`
+	// MinVersion is 1.0, 1.1, 1.2 or 1.3.
+	MinVersion string `yaml:"minVersion"`
+	// CipherSuites names the suites of TLS 1.2 and older, TLS 1.3 ones
+	// cannot be configured.
+	CipherSuites []string `yaml:"cipherSuites"`
+}
+
+// CertificateConfig is a certificate of the TLS listener, picked for the
+// server names (SNI) it is valid for.
+type CertificateConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// ServiceConfig is a backend the routes send requests to, either a single
+// origin or several upstreams.
+type ServiceConfig struct {
+	Origin    string           `yaml:"origin"`
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+	// Balancer is one of round-robin (default), weighted-round-robin,
+	// least-connections, power-of-two-choices or consistent-hash.
+	Balancer string `yaml:"balancer"`
+	// HashKey is the key of consistent-hash: url (default), client-ip,
+	// header:<name> or cookie:<name>.
+	HashKey        string                `yaml:"hashKey"`
+	HealthCheck    *HealthCheckConfig    `yaml:"healthCheck"`
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuitBreaker"`
+	Sticky         *StickyConfig         `yaml:"sticky"`
+}
+
+// HealthCheckConfig probes the upstreams of a service, see
+// proxycache.HealthCheck for the defaults.
+type HealthCheckConfig struct {
+	Path               string        `yaml:"path"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	Status             int           `yaml:"status"`
+	HealthyThreshold   int           `yaml:"healthyThreshold"`
+	UnhealthyThreshold int           `yaml:"unhealthyThreshold"`
+}
+
+// UpstreamConfig is one server of a service, Weight defaulting to 1.
+type UpstreamConfig struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"`
+}
+
+// RouteConfig matches requests, see proxycache.Route, and sends them to a
+// service after rewriting them.
+type RouteConfig struct {
+	Name       string            `yaml:"name"`
+	Service    string            `yaml:"service"`
+	Priority   int               `yaml:"priority"`
+	Hosts      []string          `yaml:"hosts"`
+	PathPrefix string            `yaml:"pathPrefix"`
+	Methods    []string          `yaml:"methods"`
+	Headers    map[string]string `yaml:"headers"`
+	Query      map[string]string `yaml:"query"`
+	// Timeout overrides --upstream-timeout for the route.
+	Timeout       *time.Duration `yaml:"timeout"`
+	NoCache       bool           `yaml:"noCache"`
+	Retry         *RetryConfig   `yaml:"retry"`
+	RewriteConfig `yaml:",inline"`
+}
+
+// TCPConfig is a TCP entrypoint forwarding the connections to a service,
+// or to the service of their TLS server name with SNI routes.
+type TCPConfig struct {
+	Name    string `yaml:"name"`
+	Listen  string `yaml:"listen"`
+	Service string `yaml:"service"`
+	// SNI maps server names, or "*." prefixed domains, to services.
+	SNI         map[string]string `yaml:"sni"`
+	DialTimeout *time.Duration    `yaml:"dialTimeout"`
+	IdleTimeout time.Duration     `yaml:"idleTimeout"`
+}
+
+// UDPConfig is an UDP entrypoint forwarding the datagrams to a service.
+type UDPConfig struct {
+	Name        string        `yaml:"name"`
+	Listen      string        `yaml:"listen"`
+	Service     string        `yaml:"service"`
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+}
+
+// RetryConfig retries the failed requests of a route, see
+// proxycache.RetryPolicy for the defaults.
+type RetryConfig struct {
+	Attempts       int           `yaml:"attempts"`
+	Statuses       []int         `yaml:"statuses"`
+	Methods        []string      `yaml:"methods"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+	Budget         float64       `yaml:"budget"`
+	MinRetries     int           `yaml:"minRetries"`
+	BudgetWindow   time.Duration `yaml:"budgetWindow"`
+}
+
+// RewriteConfig lists the rewrites of the request URL, set by flags or per
+// route.
+type RewriteConfig struct {
+	StripPrefix []string `yaml:"stripPrefix"`
+	AddPrefix   string   `yaml:"addPrefix"`
+	// ReplacePathRegex is a <regex>=<replacement> rule.
+	ReplacePathRegex string            `yaml:"replacePathRegex"`
+	QuerySet         map[string]string `yaml:"querySet"`
+	QueryAdd         map[string]string `yaml:"queryAdd"`
+	QueryDel         []string          `yaml:"queryDel"`
+}
+
+// loadConfig reads and checks the configuration file at path.
+func loadConfig(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	defer file.Close()
+	config := new(Config)
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if len(config.Routes) == 0 && len(config.TCP) == 0 && len(config.UDP) == 0 {
+		return nil, fmt.Errorf("invalid config %s: no route nor tcp/udp entrypoint", path)
+	}
+	for i, route := range config.Routes {
+		if _, ok := config.Services[route.Service]; !ok {
+			return nil, fmt.Errorf("invalid config %s: route %d (%s) has unknown service %q", path, i, route.Name, route.Service)
+		}
+	}
+	for i, entrypoint := range config.TCP {
+		if entrypoint.Listen == "" {
+			return nil, fmt.Errorf("invalid config %s: tcp entrypoint %d (%s) has no listen address", path, i, entrypoint.Name)
+		}
+		services := slices.Collect(maps.Values(entrypoint.SNI))
+		if entrypoint.Service != "" || len(services) == 0 {
+			services = append(services, entrypoint.Service)
+		}
+		for _, service := range services {
+			if _, ok := config.Services[service]; !ok {
+				return nil, fmt.Errorf("invalid config %s: tcp entrypoint %d (%s) has unknown service %q", path, i, entrypoint.Name, service)
+			}
+		}
+	}
+	if config.TLS != nil {
+		for i, certificate := range config.TLS.Certificates {
+			if certificate.CertFile == "" || certificate.KeyFile == "" {
+				return nil, fmt.Errorf("invalid config %s: tls certificate %d needs certFile and keyFile", path, i)
+			}
+		}
+	}
+	for i, entrypoint := range config.UDP {
+		if entrypoint.Listen == "" {
+			return nil, fmt.Errorf("invalid config %s: udp entrypoint %d (%s) has no listen address", path, i, entrypoint.Name)
+		}
+		if _, ok := config.Services[entrypoint.Service]; !ok {
+			return nil, fmt.Errorf("invalid config %s: udp entrypoint %d (%s) has unknown service %q", path, i, entrypoint.Name, entrypoint.Service)
+		}
+	}
+	return config, nil
+}
+
+// defaultConfig returns the configuration of a single route to origin, used
+// without config file.
+func defaultConfig(origin string, rewrites RewriteConfig) *Config {
+	return &Config{
+		Services: map[string]ServiceConfig{"default": {Origin: origin}},
+		Routes:   []RouteConfig{{Name: "default", Service: "default", RewriteConfig: rewrites}},
+	}
+}
+
+// newServices builds the services of config, whose health checks use
+// transport.
+func newServices(config *Config, transport http.RoundTripper) (map[string]*proxycache.Service, error) {
+	services := map[string]*proxycache.Service{}
+	for name, service := range config.Services {
+		s, err := service.build(transport)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service %q: %w", name, err)
+		}
+		services[name] = s
+	}
+	return services, nil
+}
+
+// newRouter builds a proxy per route, with the options shared by all the
+// routes and the route ones. The routes of a service share its upstreams.
+func newRouter(config *Config, services map[string]*proxycache.Service, cacheMiddleware proxycache.Middleware, options ...proxycache.ProxyOptions) (*proxycache.Router, error) {
+	var routes []*proxycache.Route
+	for _, route := range config.Routes {
+		rewrites, err := route.middlewares()
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q: %w", route.Name, err)
+		}
+		// the cache comes first, so that its keys are the URLs clients ask for
+		routeOptions := slices.Clone(options)
+		if !route.NoCache {
+			routeOptions = append(routeOptions, proxycache.WithMiddlewares(cacheMiddleware))
+		}
+		routeOptions = append(routeOptions, proxycache.WithMiddlewares(rewrites...))
+		if route.Timeout != nil {
+			routeOptions = append(routeOptions, proxycache.WithUpstreamTimeout(*route.Timeout))
+		}
+		if retry := route.Retry; retry != nil {
+			routeOptions = append(routeOptions, proxycache.WithRetry(proxycache.RetryPolicy{
+				Attempts:       retry.Attempts,
+				Statuses:       retry.Statuses,
+				Methods:        retry.Methods,
+				InitialBackoff: retry.InitialBackoff,
+				MaxBackoff:     retry.MaxBackoff,
+				Budget:         retry.Budget,
+				MinRetries:     retry.MinRetries,
+				BudgetWindow:   retry.BudgetWindow,
+			}))
+		}
+		proxy, err := proxycache.NewServiceProxy(services[route.Service], routeOptions...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q: %w", route.Name, err)
+		}
+		routes = append(routes, &proxycache.Route{
+			Name:       route.Name,
+			Priority:   route.Priority,
+			Hosts:      route.Hosts,
+			PathPrefix: route.PathPrefix,
+			Methods:    route.Methods,
+			Headers:    route.Headers,
+			Query:      route.Query,
+			Handler:    proxy,
+		})
+	}
+	return proxycache.NewRouter(routes...)
+}
+
+// build returns the proxy of the TCP entrypoint, to services.
+func (c TCPConfig) build(services map[string]*proxycache.Service) (*proxycache.TCPProxy, error) {
+	options := []proxycache.TCPProxyOptions{proxycache.WithTCPIdleTimeout(c.IdleTimeout)}
+	if c.DialTimeout != nil {
+		options = append(options, proxycache.WithTCPDialTimeout(*c.DialTimeout))
+	}
+	for serverName, service := range c.SNI {
+		options = append(options, proxycache.WithSNIRoute(serverName, services[service]))
+	}
+	proxy, err := proxycache.NewTCPProxy(services[c.Service], options...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tcp entrypoint %q: %w", c.Name, err)
+	}
+	return proxy, nil
+}
+
+// build returns the proxy of the UDP entrypoint, to services.
+func (c UDPConfig) build(services map[string]*proxycache.Service) (*proxycache.UDPProxy, error) {
+	var options []proxycache.UDPProxyOptions
+	if c.IdleTimeout != 0 {
+		options = append(options, proxycache.WithUDPIdleTimeout(c.IdleTimeout))
+	}
+	proxy, err := proxycache.NewUDPProxy(services[c.Service], options...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid udp entrypoint %q: %w", c.Name, err)
+	}
+	return proxy, nil
+}
+
+// CircuitBreakerConfig ejects the failing upstreams of a service, see
+// proxycache.CircuitBreaker for the defaults.
+type CircuitBreakerConfig struct {
+	ConsecutiveFailures int           `yaml:"consecutiveFailures"`
+	FailureRatio        float64       `yaml:"failureRatio"`
+	MinRequests         int           `yaml:"minRequests"`
+	Window              time.Duration `yaml:"window"`
+	Backoff             time.Duration `yaml:"backoff"`
+	MaxBackoff          time.Duration `yaml:"maxBackoff"`
+	HalfOpenRequests    int           `yaml:"halfOpenRequests"`
+}
+
+// StickyConfig pins the clients to an upstream with a signed cookie, see
+// proxycache.StickySessions.
+type StickyConfig struct {
+	Cookie string `yaml:"cookie"`
+	// Secret signs the cookies, random when empty so that sessions are
+	// rebalanced on restart.
+	Secret   string        `yaml:"secret"`
+	TTL      time.Duration `yaml:"ttl"`
+	Path     string        `yaml:"path"`
+	Domain   string        `yaml:"domain"`
+	Secure   bool          `yaml:"secure"`
+	HTTPOnly bool          `yaml:"httpOnly"`
+	// SameSite is lax, strict or none, unset when empty.
+	SameSite string `yaml:"sameSite"`
+}
+
+var sameSiteModes = map[string]http.SameSite{
+	"":       http.SameSiteDefaultMode,
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// build returns the service, with its balancer, health check, circuit
+// breaker and sticky sessions.
+func (c ServiceConfig) build(transport http.RoundTripper) (*proxycache.Service, error) {
+	upstreamConfigs := c.Upstreams
+	if c.Origin != "" {
+		upstreamConfigs = append([]UpstreamConfig{{URL: c.Origin}}, upstreamConfigs...)
+	}
+	var upstreams []*proxycache.Upstream
+	for _, upstreamConfig := range upstreamConfigs {
+		upstream, err := proxycache.NewUpstream(upstreamConfig.URL, upstreamConfig.Weight)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	balancer, err := c.balancer()
+	if err != nil {
+		return nil, err
+	}
+	options := []proxycache.ServiceOptions{proxycache.WithBalancer(balancer)}
+	if check := c.HealthCheck; check != nil {
+		options = append(options, proxycache.WithHealthCheck(proxycache.HealthCheck{
+			Path:               check.Path,
+			Interval:           check.Interval,
+			Timeout:            check.Timeout,
+			Status:             check.Status,
+			HealthyThreshold:   check.HealthyThreshold,
+			UnhealthyThreshold: check.UnhealthyThreshold,
+			Transport:          transport,
+		}))
+	}
+	if cb := c.CircuitBreaker; cb != nil {
+		options = append(options, proxycache.WithCircuitBreaker(proxycache.CircuitBreaker{
+			ConsecutiveFailures: cb.ConsecutiveFailures,
+			FailureRatio:        cb.FailureRatio,
+			MinRequests:         cb.MinRequests,
+			Window:              cb.Window,
+			Backoff:             cb.Backoff,
+			MaxBackoff:          cb.MaxBackoff,
+			HalfOpenRequests:    cb.HalfOpenRequests,
+		}))
+	}
+	if sticky := c.Sticky; sticky != nil {
+		sameSite, ok := sameSiteModes[sticky.SameSite]
+		if !ok {
+			return nil, fmt.Errorf("invalid sticky sameSite %q: must be lax, strict or none", sticky.SameSite)
+		}
+		options = append(options, proxycache.WithStickySessions(proxycache.StickySessions{
+			Cookie:   sticky.Cookie,
+			Secret:   []byte(sticky.Secret),
+			TTL:      sticky.TTL,
+			Path:     sticky.Path,
+			Domain:   sticky.Domain,
+			Secure:   sticky.Secure,
+			HTTPOnly: sticky.HTTPOnly,
+			SameSite: sameSite,
+		}))
+	}
+	return proxycache.NewService(upstreams, options...)
+}
+
+func (c ServiceConfig) balancer() (proxycache.Balancer, error) {
+	switch c.Balancer {
+	case "", "round-robin":
+		return proxycache.RoundRobin(), nil
+	case "weighted-round-robin":
+		return proxycache.WeightedRoundRobin(), nil
+	case "least-connections":
+		return proxycache.LeastConnections(), nil
+	case "power-of-two-choices":
+		return proxycache.PowerOfTwoChoices(), nil
+	case "consistent-hash":
+		key, err := hashKey(c.HashKey)
+		if err != nil {
+			return nil, err
+		}
+		return proxycache.ConsistentHash(key), nil
+	}
+	return nil, fmt.Errorf("unknown balancer %q", c.Balancer)
+}
+
+func hashKey(key string) (proxycache.HashKey, error) {
+	if name, ok := strings.CutPrefix(key, "header:"); ok && name != "" {
+		return proxycache.HashByHeader(name), nil
+	}
+	if name, ok := strings.CutPrefix(key, "cookie:"); ok && name != "" {
+		return proxycache.HashByCookie(name), nil
+	}
+	switch key {
+	case "", "url":
+		return proxycache.HashByURL, nil
+	case "client-ip":
+		return proxycache.HashByClientIP, nil
+	}
+	return nil, fmt.Errorf("unknown hash key %q", key)
+}
+
+// middlewares returns the middlewares rewriting the request URL.
+func (c RewriteConfig) middlewares() ([]proxycache.Middleware, error) {
+	var middlewares []proxycache.Middleware
+	if len(c.StripPrefix) > 0 {
+		middlewares = append(middlewares, proxycache.StripPrefix(c.StripPrefix...))
+	}
+	if c.AddPrefix != "" {
+		middlewares = append(middlewares, proxycache.AddPrefix(c.AddPrefix))
+	}
+	if c.ReplacePathRegex != "" {
+		pattern, replacement, ok := strings.Cut(c.ReplacePathRegex, "=")
+		if !ok {
+			return nil, fmt.Errorf("replace-path-regex must be <regex>=<replacement>, got %q", c.ReplacePathRegex)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replace-path-regex: %w", err)
+		}
+		middlewares = append(middlewares, proxycache.ReplacePathRegex(re, replacement))
+	}
+	if len(c.QuerySet) > 0 || len(c.QueryAdd) > 0 || len(c.QueryDel) > 0 {
+		middlewares = append(middlewares, proxycache.RewriteQuery(proxycache.QueryRules{
+			Delete: c.QueryDel,
+			Set:    c.QuerySet,
+			Add:    c.QueryAdd,
+		}))
+	}
+	return middlewares, nil
+}
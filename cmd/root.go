@@ -4,20 +4,62 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/LBF38/proxycache/internal"
+	"github.com/LBF38/proxycache/proxycache"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/spf13/cobra"
 )
 
 var port int
 var host string
 var origin string
+var setCookiePolicy string
+var tagHeader string
+var adminAddr string
+var adminToken string
+var purgeMethod string
+var banMethod string
+var purgeNetworks []string
+var purgeSecret string
+var warmSource string
+var startupWarmConcurrency int
+var startupWarmRate float64
+var transportOptions = proxycache.DefaultTransportOptions()
+var upstreamCA string
+var upstreamInsecure bool
+var trustedProxies []string
+var flushInterval time.Duration
+var upstreamTimeout time.Duration
+var detachedFill time.Duration
+var errorFormat string
+var rewrites RewriteConfig
+var configFile string
+var upgradeIdleTimeout time.Duration
+var tlsPort int
+var tlsCert string
+var tlsKey string
+var tlsMinVersion string
+var tlsCipherSuites []string
+var tlsWatchInterval time.Duration
+var h2c bool
+var http3Enabled bool
 
 var rootCmd = &cobra.Command{
 	Use:   "proxycache",
@@ -29,17 +71,361 @@ This is a challenge to build an HTTP reverse proxy from scratch in Go and with c
 			fmt.Fprintf(os.Stderr, "Error: port must be between 1 and 65535\n")
 			os.Exit(1)
 		}
+		if tlsPort < 0 || tlsPort > 65535 {
+			fmt.Fprintf(os.Stderr, "Error: tls-port must be between 1 and 65535, or 0 to disable TLS\n")
+			os.Exit(1)
+		}
+		if (tlsCert == "") != (tlsKey == "") {
+			fmt.Fprintf(os.Stderr, "Error: tls-cert and tls-key must be set together\n")
+			os.Exit(1)
+		}
+		if http3Enabled && tlsPort == 0 {
+			fmt.Fprintf(os.Stderr, "Error: tls-port is required with http3\n")
+			os.Exit(1)
+		}
+
+		policy := proxycache.SetCookiePolicy(setCookiePolicy)
+		if policy != proxycache.SetCookieStrip && policy != proxycache.SetCookieBypass {
+			fmt.Fprintf(os.Stderr, "Error: cache-set-cookie must be %q or %q\n", proxycache.SetCookieStrip, proxycache.SetCookieBypass)
+			os.Exit(1)
+		}
+
+		// read after parsing, so that the usage text never shows the secrets
+		if !cmd.Flags().Changed("admin-token") {
+			adminToken = os.Getenv("PROXYCACHE_ADMIN_TOKEN")
+		}
+		if !cmd.Flags().Changed("purge-secret") {
+			purgeSecret = os.Getenv("PROXYCACHE_PURGE_SECRET")
+		}
+		if adminAddr != "" && adminToken == "" {
+			fmt.Fprintf(os.Stderr, "Error: admin-token (or PROXYCACHE_ADMIN_TOKEN) is required with admin-addr\n")
+			os.Exit(1)
+		}
+
+		networks, err := parseNetworks(purgeNetworks)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid purge-allow: %v\n", err)
+			os.Exit(1)
+		}
+		trusted, err := parseNetworks(trustedProxies)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid trusted-proxies: %v\n", err)
+			os.Exit(1)
+		}
+
+		errorHandlers := map[string]proxycache.ErrorHandler{
+			"text": proxycache.DefaultErrorHandler,
+			"json": proxycache.ProblemDetailsErrorHandler,
+		}
+		errorHandler, ok := errorHandlers[errorFormat]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: error-format must be \"text\" or \"json\"\n")
+			os.Exit(1)
+		}
+
+		tlsConfig, err := upstreamTLSConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		transportOptions.TLSClientConfig = tlsConfig
+
+		cache := proxycache.NewInMemoryCache(1024 * 1024)
+		cacheMiddleware := proxycache.CacheMiddleware(cache,
+			proxycache.WithSetCookiePolicy(policy),
+			proxycache.WithTagHeader(tagHeader),
+			proxycache.WithPurgeMethod(purgeMethod),
+			proxycache.WithBanMethod(banMethod),
+			proxycache.WithPurgeNetworks(networks...),
+			proxycache.WithPurgeSecret(purgeSecret),
+			proxycache.WithDetachedFill(detachedFill),
+		)
+		config := defaultConfig(origin, rewrites)
+		if configFile != "" {
+			if config, err = loadConfig(configFile); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		// a config of TCP/UDP entrypoints only runs no HTTP listener
+		serveHTTP := len(config.Routes) > 0
+		if !serveHTTP && (tlsPort != 0 || warmSource != "") {
+			fmt.Fprintf(os.Stderr, "Error: tls-port and warm need routes in the config\n")
+			os.Exit(1)
+		}
+
+		transport := proxycache.NewTransport(transportOptions)
+		services, err := newServices(config, transport)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		var router *proxycache.Router
+		if serveHTTP {
+			router, err = newRouter(config, services, cacheMiddleware,
+				proxycache.WithTransport(transport),
+				proxycache.WithTrustedProxies(trusted...),
+				proxycache.WithFlushInterval(flushInterval),
+				proxycache.WithUpstreamTimeout(upstreamTimeout),
+				proxycache.WithErrorHandler(errorHandler),
+				proxycache.WithUpgradeIdleTimeout(upgradeIdleTimeout),
+			)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		for _, service := range services {
+			go service.RunHealthChecks(context.Background())
+		}
+		for _, entrypoint := range config.TCP {
+			proxy, err := entrypoint.build(services)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			ln, err := net.Listen("tcp", entrypoint.Listen)
+			if err != nil {
+				log.Fatalf("error starting tcp entrypoint %q, %v", entrypoint.Name, err)
+			}
+			log.Printf("TCP entrypoint %q listening on %s", entrypoint.Name, entrypoint.Listen)
+			go func() {
+				if err := proxy.Serve(ln); err != nil {
+					log.Fatalf("error serving tcp entrypoint %q, %v", entrypoint.Name, err)
+				}
+			}()
+		}
+		for _, entrypoint := range config.UDP {
+			proxy, err := entrypoint.build(services)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			conn, err := net.ListenPacket("udp", entrypoint.Listen)
+			if err != nil {
+				log.Fatalf("error starting udp entrypoint %q, %v", entrypoint.Name, err)
+			}
+			log.Printf("UDP entrypoint %q listening on %s", entrypoint.Name, entrypoint.Listen)
+			go func() {
+				if err := proxy.Serve(conn); err != nil {
+					log.Fatalf("error serving udp entrypoint %q, %v", entrypoint.Name, err)
+				}
+			}()
+		}
+
+		if adminAddr != "" {
+			go func() {
+				log.Printf("Admin API listening on %s", adminAddr)
+				if err := http.ListenAndServe(adminAddr, proxycache.NewAdminHandler(cache, adminToken, proxycache.WithAdminServices(services))); err != nil {
+					log.Fatalf("error starting admin API, %v", err)
+				}
+			}()
+		}
+
+		var urls []string
+		if warmSource != "" {
+			var err error
+			if urls, err = readWarmList(warmSource); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		if !serveHTTP {
+			select {} // the entrypoints serve until the process is stopped
+		}
+
+		var handler http.Handler = router
+		var h3 *http3.Server
+		if http3Enabled {
+			h3 = &http3.Server{Handler: router}
+			handler = proxycache.AltSvcMiddleware(h3)(router)
+		}
+		var tlsAddr string
+		if tlsPort != 0 {
+			listenerTLS, certificates, err := serverTLSConfig(config.TLS)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			go reloadCertificates(certificates)
+			server := newServer(handler, false)
+			server.TLSConfig = listenerTLS
+			tlsAddr = net.JoinHostPort(host, strconv.Itoa(tlsPort))
+			tlsLn, err := net.Listen("tcp", tlsAddr)
+			if err != nil {
+				log.Fatalf("error starting TLS proxy, %v", err)
+			}
+			log.Printf("Proxy listening with TLS on %s:%d", host, tlsPort)
+			go func() {
+				if err := server.ServeTLS(tlsLn, "", ""); err != nil {
+					log.Fatalf("error starting TLS proxy, %v", err)
+				}
+			}()
 
-		cache := internal.NewInMemoryCache(1024 * 1024)
-		proxy := internal.NewProxy(origin, internal.WithMiddlewares(internal.CacheMiddleware(cache)))
+			if h3 != nil {
+				conn, err := net.ListenPacket("udp", tlsAddr)
+				if err != nil {
+					log.Fatalf("error starting HTTP/3 proxy, %v", err)
+				}
+				h3.TLSConfig = server.TLSConfig
+				log.Printf("Proxy listening with HTTP/3 on %s:%d (udp)", host, tlsPort)
+				go func() {
+					if err := h3.Serve(conn); err != nil {
+						log.Fatalf("error starting HTTP/3 proxy, %v", err)
+					}
+				}()
+			}
+		}
 
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			log.Fatalf("error starting proxy, %v", err)
+		}
 		log.Printf("Proxy listening on %s:%d", host, port)
-		if err := http.ListenAndServe(net.JoinHostPort(host, strconv.Itoa(port)), proxy); err != nil {
+		if len(urls) > 0 {
+			go warmListeners(urls, ln.Addr().String(), tlsAddr)
+		}
+		if err := newServer(handler, h2c).Serve(ln); err != nil {
 			log.Fatalf("error starting proxy, %v", err)
 		}
 	},
 }
 
+// warmListeners warms the cache on startup, as the cache keys include the
+// scheme: https URLs through the TLS listener at tlsAddr, when enabled, and
+// the others through the plain listener at addr.
+func warmListeners(urls []string, addr, tlsAddr string) {
+	var plain, secure []string
+	for _, u := range urls {
+		if tlsAddr != "" && strings.HasPrefix(u, "https://") {
+			secure = append(secure, u)
+		} else {
+			plain = append(plain, u)
+		}
+	}
+	if len(plain) > 0 {
+		warm(context.Background(), nil, &url.URL{Scheme: "http", Host: addr}, plain, startupWarmConcurrency, startupWarmRate)
+	}
+	if len(secure) > 0 {
+		// the listener is this proxy, whose certificate is for other names
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		client := &http.Client{Transport: transport}
+		warm(context.Background(), client, &url.URL{Scheme: "https", Host: tlsAddr}, secure, startupWarmConcurrency, startupWarmRate)
+	}
+}
+
+// newServer returns the server of a proxy listener. HTTP/2 is negotiated
+// with ALPN over TLS and, with h2c, also accepted in cleartext with prior
+// knowledge, which only suits trusted networks.
+func newServer(handler http.Handler, h2c bool) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(h2c)
+	return &http.Server{Handler: handler, Protocols: protocols}
+}
+
+// tlsVersions are the values of --tls-min-version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// serverTLSConfig builds the TLS configuration of the proxy listener, from
+// the flags and the tls section of the config file, which may be nil. The
+// certificates are picked by server name, the --tls-cert one first.
+func serverTLSConfig(config *TLSConfig) (*tls.Config, *proxycache.Certificates, error) {
+	var files []proxycache.CertificateFiles
+	if tlsCert != "" {
+		files = append(files, proxycache.CertificateFiles{CertFile: tlsCert, KeyFile: tlsKey})
+	}
+	minVersion, cipherSuites := tlsMinVersion, tlsCipherSuites
+	if config != nil {
+		for _, certificate := range config.Certificates {
+			files = append(files, proxycache.CertificateFiles{CertFile: certificate.CertFile, KeyFile: certificate.KeyFile})
+		}
+		if config.MinVersion != "" {
+			minVersion = config.MinVersion
+		}
+		if len(config.CipherSuites) > 0 {
+			cipherSuites = config.CipherSuites
+		}
+	}
+	if len(files) == 0 {
+		return nil, nil, errors.New("tls-cert and tls-key, or tls certificates in the config, are required with tls-port")
+	}
+
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid TLS min version %q: must be 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+	var ids []uint16
+	for _, name := range cipherSuites {
+		i := slices.IndexFunc(tls.CipherSuites(), func(suite *tls.CipherSuite) bool { return suite.Name == name })
+		if i < 0 {
+			return nil, nil, fmt.Errorf("invalid TLS cipher suite %q: unknown or insecure", name)
+		}
+		ids = append(ids, tls.CipherSuites()[i].ID)
+	}
+	certificates, err := proxycache.LoadCertificates(files...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &tls.Config{GetCertificate: certificates.GetCertificate, MinVersion: version, CipherSuites: ids}, certificates, nil
+}
+
+// reloadCertificates reloads certificates on SIGHUP and, unless
+// --tls-watch-interval is 0, when their files change.
+func reloadCertificates(certificates *proxycache.Certificates) {
+	if tlsWatchInterval > 0 {
+		go certificates.Watch(context.Background(), tlsWatchInterval)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := certificates.Reload(); err != nil {
+			log.Printf("error reloading TLS certificates: %v", err)
+			continue
+		}
+		log.Printf("TLS certificates reloaded")
+	}
+}
+
+// parseNetworks parses a list of CIDR networks.
+func parseNetworks(networks []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, network := range networks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// upstreamTLSConfig builds the TLS configuration used to reach the origin.
+func upstreamTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: upstreamInsecure}
+	if upstreamCA != "" {
+		pem, err := os.ReadFile(upstreamCA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading upstream CA: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", upstreamCA)
+		}
+	}
+	return config, nil
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -51,4 +437,44 @@ func init() {
 	rootCmd.Flags().IntVarP(&port, "port", "p", 5000, "Port to expose the proxy")
 	rootCmd.Flags().StringVarP(&host, "host", "H", "localhost", "Host for the proxy")
 	rootCmd.Flags().StringVarP(&origin, "origin", "O", "http://localhost:8000", "Origin server to proxy")
+	rootCmd.Flags().StringVar(&setCookiePolicy, "cache-set-cookie", string(proxycache.SetCookieStrip), "Caching of responses with Set-Cookie: strip the header or bypass the cache")
+	rootCmd.Flags().StringVar(&tagHeader, "cache-tag-header", "Surrogate-Key", "Response header listing the cache tags of a response, empty to disable")
+	rootCmd.Flags().StringVar(&adminAddr, "admin-addr", "", "Address of the admin API (e.g. localhost:5001), disabled when empty")
+	rootCmd.Flags().StringVar(&adminToken, "admin-token", "", "Bearer token required by the admin API, PROXYCACHE_ADMIN_TOKEN when not set")
+	rootCmd.Flags().StringVar(&purgeMethod, "purge-method", "", "HTTP method purging the cached responses of an URL (e.g. PURGE), disabled when empty")
+	rootCmd.Flags().StringVar(&banMethod, "ban-method", "", "HTTP method purging the cached URLs matching the X-Ban-Url regexp (e.g. BAN), disabled when empty")
+	rootCmd.Flags().StringSliceVar(&purgeNetworks, "purge-allow", []string{"127.0.0.1/32", "::1/128"}, "Client networks (CIDR) allowed to purge")
+	rootCmd.Flags().StringVar(&purgeSecret, "purge-secret", "", "Shared secret allowing to purge with the X-Purge-Token header, PROXYCACHE_PURGE_SECRET when not set")
+	rootCmd.Flags().StringVar(&warmSource, "warm", "", "URL list or sitemap.xml (file or URL) to warm the cache with on startup, https URLs through the TLS listener")
+	rootCmd.Flags().IntVar(&startupWarmConcurrency, "warm-concurrency", 4, "Number of parallel requests when warming on startup")
+	rootCmd.Flags().Float64Var(&startupWarmRate, "warm-rate", 10, "Maximum requests per second when warming on startup, 0 for unlimited")
+	rootCmd.Flags().DurationVar(&transportOptions.DialTimeout, "upstream-dial-timeout", transportOptions.DialTimeout, "Timeout to connect to the origin, 0 for none")
+	rootCmd.Flags().DurationVar(&transportOptions.TLSHandshakeTimeout, "upstream-tls-handshake-timeout", transportOptions.TLSHandshakeTimeout, "Timeout of the TLS handshake with the origin, 0 for none")
+	rootCmd.Flags().DurationVar(&transportOptions.ResponseHeaderTimeout, "upstream-response-header-timeout", transportOptions.ResponseHeaderTimeout, "Timeout waiting for the origin response headers, 0 for none")
+	rootCmd.Flags().DurationVar(&transportOptions.IdleConnTimeout, "upstream-idle-timeout", transportOptions.IdleConnTimeout, "Time an idle connection to the origin is kept open, 0 for no limit")
+	rootCmd.Flags().IntVar(&transportOptions.MaxIdleConnsPerHost, "upstream-max-idle-conns-per-host", transportOptions.MaxIdleConnsPerHost, "Maximum idle connections kept per origin host")
+	rootCmd.Flags().IntVar(&transportOptions.MaxConnsPerHost, "upstream-max-conns-per-host", transportOptions.MaxConnsPerHost, "Maximum connections per origin host, 0 for no limit")
+	rootCmd.Flags().StringVar(&upstreamCA, "upstream-ca", "", "PEM file of the CAs trusted for HTTPS origins, system pool when empty")
+	rootCmd.Flags().BoolVar(&upstreamInsecure, "upstream-insecure-skip-verify", false, "Do not verify the certificate of HTTPS origins")
+	rootCmd.Flags().StringSliceVar(&trustedProxies, "trusted-proxies", nil, "Networks (CIDR) of the proxies in front of this one, whose forwarded headers are kept")
+	rootCmd.Flags().DurationVar(&upstreamTimeout, "upstream-timeout", 0, "Deadline of the whole upstream exchange, 0 for none")
+	rootCmd.Flags().DurationVar(&detachedFill, "cache-detached-fill", 0, "Let cache fills finish within this timeout after their client went away, 0 to cancel them with the client")
+	rootCmd.Flags().StringVar(&errorFormat, "error-format", "text", "Format of the upstream error responses: text or json (RFC 9457 problem details)")
+	rootCmd.Flags().StringSliceVar(&rewrites.StripPrefix, "strip-prefix", nil, "Path prefixes removed before forwarding, the first matching one is used")
+	rootCmd.Flags().StringVar(&rewrites.AddPrefix, "add-prefix", "", "Path prefix added before forwarding")
+	rootCmd.Flags().StringVar(&rewrites.ReplacePathRegex, "replace-path-regex", "", "Path rewrite rule as <regex>=<replacement>, e.g. '^/users/(.*)=/accounts/$1'")
+	rootCmd.Flags().StringToStringVar(&rewrites.QuerySet, "query-set", nil, "Query parameters set before forwarding, e.g. key=value")
+	rootCmd.Flags().StringToStringVar(&rewrites.QueryAdd, "query-add", nil, "Query parameters added before forwarding, e.g. key=value")
+	rootCmd.Flags().StringSliceVar(&rewrites.QueryDel, "query-del", nil, "Query parameters removed before forwarding")
+	rootCmd.Flags().StringVar(&configFile, "config", "", "YAML file of the services, routes and TCP/UDP entrypoints, replacing --origin and the rewrite flags")
+	rootCmd.Flags().DurationVar(&upgradeIdleTimeout, "upgrade-idle-timeout", 0, "Close upgraded connections (e.g. WebSockets) idle for this long, 0 for never")
+	rootCmd.Flags().IntVar(&tlsPort, "tls-port", 0, "Port to expose the proxy with TLS, HTTP/2 being negotiated with ALPN, 0 to disable")
+	rootCmd.Flags().StringVar(&tlsCert, "tls-cert", "", "PEM certificate (chain) of the TLS listener, tried before the --config ones for the server name (SNI) and served when none matches")
+	rootCmd.Flags().StringVar(&tlsKey, "tls-key", "", "PEM private key of the TLS listener")
+	rootCmd.Flags().StringVar(&tlsMinVersion, "tls-min-version", "1.2", "Minimum TLS version of the TLS listener: 1.0, 1.1, 1.2 or 1.3")
+	rootCmd.Flags().StringSliceVar(&tlsCipherSuites, "tls-cipher-suites", nil, "Cipher suites of TLS 1.2 and older on the TLS listener (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), Go defaults when empty")
+	rootCmd.Flags().DurationVar(&tlsWatchInterval, "tls-watch-interval", 10*time.Second, "Interval to check the TLS certificate files for changes, reloaded as on SIGHUP, 0 to disable")
+	rootCmd.Flags().BoolVar(&http3Enabled, "http3", false, "Also serve HTTP/3 over QUIC on the UDP port of --tls-port, advertised to TLS clients with Alt-Svc")
+	rootCmd.Flags().BoolVar(&h2c, "h2c", false, "Accept cleartext HTTP/2 (h2c with prior knowledge) on the plain listener, for internal traffic")
+	rootCmd.Flags().DurationVar(&flushInterval, "flush-interval", 0, "Interval to flush responses to the client, 0 for none and negative for every write (streams are always flushed)")
 }
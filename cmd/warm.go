@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/LBF38/proxycache/proxycache"
+	"github.com/spf13/cobra"
+)
+
+var warmTarget string
+var warmConcurrency int
+var warmRate float64
+
+var warmCmd = &cobra.Command{
+	Use:   "warm <file or URL>",
+	Short: "Warm the cache of a running proxy",
+	Long: `Warm the cache of a running proxy from a list of URLs (one per line) or a sitemap.xml.
+Each URL is requested through the proxy, so that its response gets cached.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		target, err := url.Parse(warmTarget)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			fmt.Fprintf(os.Stderr, "Error: invalid target %q\n", warmTarget)
+			os.Exit(1)
+		}
+		urls, err := readWarmList(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if failed := warm(ctx, nil, target, urls, warmConcurrency, warmRate); failed > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// warm warms the proxy at target with urls, using client or else the
+// default one, prints the status of each URL and returns how many failed.
+func warm(ctx context.Context, client *http.Client, target *url.URL, urls []string, concurrency int, rate float64) int {
+	warmer := &proxycache.Warmer{Client: client, Concurrency: concurrency, Rate: rate}
+	var failed int
+	warmer.Warm(ctx, target, urls, func(result proxycache.WarmResult) {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("ERROR %s: %v\n", result.URL, result.Err)
+			return
+		}
+		if result.StatusCode >= 400 {
+			failed++
+		}
+		fmt.Printf("%d %-6s %s (%v)\n", result.StatusCode, result.CacheStatus, result.URL, result.Duration)
+	})
+	fmt.Printf("warmed %d URLs, %d failed\n", len(urls), failed)
+	return failed
+}
+
+// readWarmList reads the URLs to warm from a local file or an http(s) URL.
+func readWarmList(source string) ([]string, error) {
+	var r io.Reader
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := http.Get(source)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching %s: %w", source, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("error fetching %s: %s", source, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return proxycache.ReadWarmList(r)
+}
+
+func init() {
+	rootCmd.AddCommand(warmCmd)
+	warmCmd.Flags().StringVarP(&warmTarget, "target", "t", "http://localhost:5000", "URL of the proxy to warm")
+	warmCmd.Flags().IntVarP(&warmConcurrency, "concurrency", "c", 4, "Number of parallel requests")
+	warmCmd.Flags().Float64VarP(&warmRate, "rate", "r", 10, "Maximum requests per second, 0 for unlimited")
+}
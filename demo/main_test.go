@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/LBF38/proxycache/proxycache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrailerThroughProxy(t *testing.T) {
+	tests := []struct {
+		desc  string
+		http2 bool
+	}{
+		{desc: "HTTP/1.1 chunked"},
+		{desc: "HTTP/2", http2: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			origin := newServer(trailer(), tt.http2)
+			defer origin.Close()
+			handler, err := proxycache.NewProxy(origin.URL, proxycache.WithTransport(origin.Client().Transport))
+			require.NoError(t, err)
+			proxy := newServer(handler, tt.http2)
+			defer proxy.Close()
+
+			resp, err := proxy.Client().Get(proxy.URL + "/trailer")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			if tt.http2 {
+				assert.Equal(t, 2, resp.ProtoMajor)
+			} else {
+				assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+			}
+			assert.Equal(t, "body content", string(body))
+			assert.Equal(t, "Value", resp.Trailer.Get("X-Trailer"))
+			assert.Equal(t, "more things", resp.Trailer.Get("X-Random"))
+			assert.Empty(t, resp.Header.Get("X-Trailer"))
+		})
+	}
+}
+
+func newServer(handler http.Handler, http2 bool) *httptest.Server {
+	if !http2 {
+		return httptest.NewServer(handler)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	return server
+}
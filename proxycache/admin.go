@@ -0,0 +1,197 @@
+package proxycache
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// AdminEntry is the JSON representation of a cache entry in the admin API.
+type AdminEntry struct {
+	Key        string      `json:"key"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code"`
+	Size       int         `json:"size"`
+	Tags       []string    `json:"tags,omitempty"`
+	StoredAt   time.Time   `json:"stored_at"`
+	ExpiresAt  *time.Time  `json:"expires_at,omitempty"`
+	Fresh      bool        `json:"fresh"`
+	Header     http.Header `json:"header,omitempty"`
+}
+
+type admin struct {
+	cache    PurgeableCache
+	token    string
+	services map[string]*Service
+}
+
+type AdminOptions func(*admin)
+
+// WithAdminServices exposes the state of the upstreams of services, by
+// name, in the metrics.
+func WithAdminServices(services map[string]*Service) AdminOptions {
+	return func(a *admin) {
+		a.services = services
+	}
+}
+
+// NewAdminHandler returns the admin API used to inspect and purge cache.
+// Every request must carry the token as "Authorization: Bearer <token>".
+//
+//	GET    /cache/entries          list the entries
+//	DELETE /cache/entries          clear the cache
+//	GET    /cache/entries/{key}    show one entry with its headers
+//	DELETE /cache/entries/{key}    purge one entry
+//	POST   /cache/purge?prefix=... purge the entries under an URL prefix
+//	POST   /cache/purge?tag=...    purge the entries with a tag
+//	GET    /metrics                upstream metrics, Prometheus text format
+func NewAdminHandler(cache PurgeableCache, token string, options ...AdminOptions) http.Handler {
+	a := &admin{cache: cache, token: token}
+	for _, option := range options {
+		option(a)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /cache/entries", a.list)
+	mux.HandleFunc("DELETE /cache/entries", a.clear)
+	mux.HandleFunc("GET /cache/entries/{key...}", a.get)
+	mux.HandleFunc("DELETE /cache/entries/{key...}", a.delete)
+	mux.HandleFunc("POST /cache/purge", a.purge)
+	mux.HandleFunc("GET /metrics", a.metrics)
+	return a.authenticate(mux)
+}
+
+func (a *admin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.token == "" || !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *admin) list(w http.ResponseWriter, r *http.Request) {
+	keys, err := a.cache.Keys()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	slices.Sort(keys)
+	now := time.Now()
+	entries := []AdminEntry{}
+	for _, key := range keys {
+		entity, err := a.cache.Get(key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if entity == nil {
+			continue // purged in the meantime
+		}
+		entries = append(entries, newAdminEntry(key, entity, now))
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (a *admin) get(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	entity, err := a.cache.Get(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if entity == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "entry not found"})
+		return
+	}
+	entry := newAdminEntry(key, entity, time.Now())
+	entry.Header = entity.Header
+	writeJSON(w, http.StatusOK, entry)
+}
+
+func (a *admin) delete(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	entity, err := a.cache.Get(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if entity == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "entry not found"})
+		return
+	}
+	if err := a.cache.Delete(key); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"purged": 1})
+}
+
+func (a *admin) clear(w http.ResponseWriter, r *http.Request) {
+	keys, err := a.cache.Keys()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := a.cache.Clear(); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"purged": len(keys)})
+}
+
+func (a *admin) purge(w http.ResponseWriter, r *http.Request) {
+	prefix, tag := r.URL.Query().Get("prefix"), r.URL.Query().Get("tag")
+	var purged int
+	var err error
+	switch {
+	case tag != "" && prefix == "":
+		purged, err = a.cache.PurgeTag(tag)
+	case prefix != "" && tag == "":
+		purged, err = purgeMatching(a.cache, func(entity *CacheEntity) bool {
+			return strings.HasPrefix(entity.URL, prefix)
+		})
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "exactly one of prefix or tag is required"})
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
+
+func newAdminEntry(key string, entity *CacheEntity, now time.Time) AdminEntry {
+	entry := AdminEntry{
+		Key:        key,
+		URL:        entity.URL,
+		StatusCode: entity.StatusCode,
+		Size:       len(entity.Body),
+		Tags:       entity.Tags,
+		StoredAt:   entity.StoredAt,
+		Fresh:      entity.Fresh(now),
+	}
+	if !entity.ExpiresAt.IsZero() {
+		entry.ExpiresAt = &entity.ExpiresAt
+	}
+	return entry
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error encoding response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	log.Printf("admin error: %v", err)
+	writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
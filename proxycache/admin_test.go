@@ -0,0 +1,143 @@
+package proxycache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmin(t *testing.T) {
+	newCache := func() *InMemoryCache {
+		cache := NewInMemoryCache(10)
+		cache.Set("a", &CacheEntity{StatusCode: 200, URL: "/products/1", Body: []byte("p1"), Tags: []string{"products"}, Header: http.Header{"Content-Type": {"text/plain"}}})
+		cache.Set("b", &CacheEntity{StatusCode: 200, URL: "/products/2", Body: []byte("p2"), Tags: []string{"products"}})
+		cache.Set("c", &CacheEntity{StatusCode: 404, URL: "/home", ExpiresAt: time.Now().Add(-time.Minute)})
+		return cache
+	}
+	do := func(handler http.Handler, method, target string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("requires the token", func(t *testing.T) {
+		handler := NewAdminHandler(newCache(), "secret")
+		for _, header := range []string{"", "Bearer wrong", "secret"} {
+			request := httptest.NewRequest(http.MethodGet, "/cache/entries", nil)
+			request.Header.Set("Authorization", header)
+			response := httptest.NewRecorder()
+
+			handler.ServeHTTP(response, request)
+
+			assert.Equal(t, http.StatusUnauthorized, response.Code, header)
+		}
+	})
+
+	t.Run("empty token is refused", func(t *testing.T) {
+		handler := NewAdminHandler(newCache(), "")
+		request := httptest.NewRequest(http.MethodGet, "/cache/entries", nil)
+		request.Header.Set("Authorization", "Bearer ")
+		response := httptest.NewRecorder()
+
+		handler.ServeHTTP(response, request)
+
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+	})
+
+	t.Run("list entries", func(t *testing.T) {
+		response := do(NewAdminHandler(newCache(), "secret"), http.MethodGet, "/cache/entries")
+
+		require.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, "application/json", response.Header().Get("Content-Type"))
+		var entries []AdminEntry
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&entries))
+		require.Len(t, entries, 3)
+		assert.Equal(t, "a", entries[0].Key)
+		assert.Equal(t, "/products/1", entries[0].URL)
+		assert.Equal(t, 2, entries[0].Size)
+		assert.True(t, entries[0].Fresh)
+		assert.Nil(t, entries[0].Header)
+		assert.False(t, entries[2].Fresh)
+		assert.NotNil(t, entries[2].ExpiresAt)
+	})
+
+	t.Run("get entry", func(t *testing.T) {
+		handler := NewAdminHandler(newCache(), "secret")
+
+		response := do(handler, http.MethodGet, "/cache/entries/a")
+
+		require.Equal(t, http.StatusOK, response.Code)
+		var entry AdminEntry
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&entry))
+		assert.Equal(t, "text/plain", entry.Header.Get("Content-Type"))
+		assert.Equal(t, http.StatusNotFound, do(handler, http.MethodGet, "/cache/entries/unknown").Code)
+	})
+
+	t.Run("get entry with a real key", func(t *testing.T) {
+		cache := NewInMemoryCache(10)
+		key := getETag(httptest.NewRequest(http.MethodGet, "/some/path?query=1", nil))
+		cache.Set(key, &CacheEntity{StatusCode: 200})
+
+		response := do(NewAdminHandler(cache, "secret"), http.MethodGet, "/cache/entries/"+url.PathEscape(key))
+
+		assert.Equal(t, http.StatusOK, response.Code)
+	})
+
+	t.Run("delete entry", func(t *testing.T) {
+		cache := newCache()
+		handler := NewAdminHandler(cache, "secret")
+
+		response := do(handler, http.MethodDelete, "/cache/entries/a")
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, `{"purged": 1}`, response.Body.String())
+		entity, _ := cache.Get("a")
+		assert.Nil(t, entity)
+		assert.Equal(t, http.StatusNotFound, do(handler, http.MethodDelete, "/cache/entries/a").Code)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		cache := newCache()
+
+		response := do(NewAdminHandler(cache, "secret"), http.MethodDelete, "/cache/entries")
+
+		assert.JSONEq(t, `{"purged": 3}`, response.Body.String())
+		keys, _ := cache.Keys()
+		assert.Empty(t, keys)
+	})
+
+	t.Run("purge by prefix", func(t *testing.T) {
+		cache := newCache()
+
+		response := do(NewAdminHandler(cache, "secret"), http.MethodPost, "/cache/purge?prefix=/products/")
+
+		assert.JSONEq(t, `{"purged": 2}`, response.Body.String())
+		keys, _ := cache.Keys()
+		assert.Equal(t, []string{"c"}, keys)
+	})
+
+	t.Run("purge by tag", func(t *testing.T) {
+		cache := newCache()
+
+		response := do(NewAdminHandler(cache, "secret"), http.MethodPost, "/cache/purge?tag=products")
+
+		assert.JSONEq(t, `{"purged": 2}`, response.Body.String())
+		keys, _ := cache.Keys()
+		assert.Equal(t, []string{"c"}, keys)
+	})
+
+	t.Run("purge needs exactly one criterion", func(t *testing.T) {
+		handler := NewAdminHandler(newCache(), "secret")
+
+		assert.Equal(t, http.StatusBadRequest, do(handler, http.MethodPost, "/cache/purge").Code)
+		assert.Equal(t, http.StatusBadRequest, do(handler, http.MethodPost, "/cache/purge?tag=a&prefix=/").Code)
+	})
+}
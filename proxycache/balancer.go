@@ -0,0 +1,166 @@
+package proxycache
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Balancer picks the upstream of a request among the available upstreams,
+// which are never empty. Implementations must be safe for concurrent use.
+type Balancer interface {
+	Pick(upstreams []*Upstream, r *http.Request) *Upstream
+}
+
+// BalancerFunc adapts a function to the Balancer interface.
+type BalancerFunc func(upstreams []*Upstream, r *http.Request) *Upstream
+
+func (f BalancerFunc) Pick(upstreams []*Upstream, r *http.Request) *Upstream {
+	return f(upstreams, r)
+}
+
+// RoundRobin picks the upstreams in turn.
+func RoundRobin() Balancer {
+	var next atomic.Uint64
+	return BalancerFunc(func(upstreams []*Upstream, r *http.Request) *Upstream {
+		return upstreams[(next.Add(1)-1)%uint64(len(upstreams))]
+	})
+}
+
+// WeightedRoundRobin picks the upstreams in turn, in proportion to their
+// weight. It is the smooth variant of nginx, which interleaves the picks of
+// the heaviest upstreams with the others instead of sending them in bursts.
+func WeightedRoundRobin() Balancer {
+	var mu sync.Mutex
+	current := map[*Upstream]int{}
+	return BalancerFunc(func(upstreams []*Upstream, r *http.Request) *Upstream {
+		mu.Lock()
+		defer mu.Unlock()
+		var best *Upstream
+		total := 0
+		for _, upstream := range upstreams {
+			current[upstream] += upstream.weight()
+			total += upstream.weight()
+			if best == nil || current[upstream] > current[best] {
+				best = upstream
+			}
+		}
+		current[best] -= total
+		return best
+	})
+}
+
+// LeastConnections picks the upstream with the fewest requests in flight
+// relative to its weight, the first one on ties.
+func LeastConnections() Balancer {
+	return BalancerFunc(func(upstreams []*Upstream, r *http.Request) *Upstream {
+		var best *Upstream
+		for _, upstream := range upstreams {
+			if best == nil || upstream.Active()*int64(best.weight()) < best.Active()*int64(upstream.weight()) {
+				best = upstream
+			}
+		}
+		return best
+	})
+}
+
+// PowerOfTwoChoices picks two random upstreams and keeps the one with the
+// fewest requests in flight, which avoids the herding of LeastConnections
+// when many requests arrive at once.
+func PowerOfTwoChoices() Balancer {
+	return BalancerFunc(func(upstreams []*Upstream, r *http.Request) *Upstream {
+		if len(upstreams) == 1 {
+			return upstreams[0]
+		}
+		i := rand.IntN(len(upstreams))
+		j := rand.IntN(len(upstreams) - 1)
+		if j >= i {
+			j++
+		}
+		a, b := upstreams[i], upstreams[j]
+		if b.Active()*int64(a.weight()) < a.Active()*int64(b.weight()) {
+			return b
+		}
+		return a
+	})
+}
+
+// HashKey returns the key ConsistentHash balances a request on.
+type HashKey func(r *http.Request) string
+
+// HashByURL keys requests on their host and URL, so that each upstream of a
+// sharded origin always serves, and caches, the same resources.
+func HashByURL(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// HashByClientIP keys requests on the address of the client.
+func HashByClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// HashByHeader keys requests on the value of a header.
+func HashByHeader(name string) HashKey {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// HashByCookie keys requests on the value of a cookie, empty when missing.
+func HashByCookie(name string) HashKey {
+	return func(r *http.Request) string {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+}
+
+// ConsistentHash sends the requests of the same key to the same upstream,
+// in proportion to the weights. It uses rendezvous hashing: when an upstream
+// goes away, only its keys move to the others.
+func ConsistentHash(key HashKey) Balancer {
+	return BalancerFunc(func(upstreams []*Upstream, r *http.Request) *Upstream {
+		k := key(r)
+		var best *Upstream
+		bestScore := math.Inf(-1)
+		for _, upstream := range upstreams {
+			if score := rendezvousScore(k, upstream); score > bestScore {
+				best, bestScore = upstream, score
+			}
+		}
+		return best
+	})
+}
+
+// rendezvousScore is the weighted score of upstream for key.
+// ref. "Weighted distributed hash tables", Schindelhauer & Schomaker, 2005
+func rendezvousScore(key string, upstream *Upstream) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(upstream.URL.String()))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	// map the hash to (0, 1), excluding both ends
+	x := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+	return -float64(upstream.weight()) / math.Log(x)
+}
+
+// mix64 is the finalizer of SplitMix64, spreading the bits of FNV hashes
+// of keys differing by their last bytes only.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
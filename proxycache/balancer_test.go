@@ -0,0 +1,163 @@
+package proxycache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestUpstreams(t *testing.T, weights ...int) []*Upstream {
+	t.Helper()
+	var upstreams []*Upstream
+	for i, weight := range weights {
+		upstream, err := NewUpstream(fmt.Sprintf("http://backend-%d", i), weight)
+		require.NoError(t, err)
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams
+}
+
+// pickCounts returns how many times each upstream is picked for n requests.
+func pickCounts(balancer Balancer, upstreams []*Upstream, n int) map[string]int {
+	counts := map[string]int{}
+	for i := range n {
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/%d", i), nil)
+		counts[balancer.Pick(upstreams, r).URL.Host]++
+	}
+	return counts
+}
+
+func TestRoundRobin(t *testing.T) {
+	upstreams := newTestUpstreams(t, 1, 1, 1)
+	balancer := RoundRobin()
+
+	var picked []string
+	for range 4 {
+		picked = append(picked, balancer.Pick(upstreams, httptest.NewRequest(http.MethodGet, "/", nil)).URL.Host)
+	}
+
+	assert.Equal(t, []string{"backend-0", "backend-1", "backend-2", "backend-0"}, picked)
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	upstreams := newTestUpstreams(t, 5, 1, 1)
+	balancer := WeightedRoundRobin()
+
+	var picked []string
+	for range 7 {
+		picked = append(picked, balancer.Pick(upstreams, httptest.NewRequest(http.MethodGet, "/", nil)).URL.Host)
+	}
+
+	// smooth: the heavy upstream is not picked 5 times in a row
+	assert.Equal(t, []string{"backend-0", "backend-0", "backend-1", "backend-0", "backend-2", "backend-0", "backend-0"}, picked)
+}
+
+func TestLeastConnections(t *testing.T) {
+	upstreams := newTestUpstreams(t, 1, 1, 2)
+	upstreams[0].active.Store(2)
+	upstreams[1].active.Store(1)
+	upstreams[2].active.Store(3)
+
+	upstream := LeastConnections().Pick(upstreams, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, "backend-1", upstream.URL.Host)
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	upstreams := newTestUpstreams(t, 1, 1)
+	upstreams[0].active.Store(10)
+
+	counts := pickCounts(PowerOfTwoChoices(), upstreams, 100)
+
+	assert.Equal(t, map[string]int{"backend-1": 100}, counts)
+}
+
+func TestConsistentHash(t *testing.T) {
+	upstreams := newTestUpstreams(t, 1, 1, 1, 1)
+	balancer := ConsistentHash(HashByURL)
+
+	t.Run("same key, same upstream", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/products/1", nil)
+		want := balancer.Pick(upstreams, r)
+
+		for range 10 {
+			assert.Same(t, want, balancer.Pick(upstreams, r))
+		}
+	})
+
+	t.Run("spread", func(t *testing.T) {
+		counts := pickCounts(balancer, upstreams, 4000)
+
+		for _, upstream := range upstreams {
+			assert.InDelta(t, 1000, counts[upstream.URL.Host], 150, upstream.URL.Host)
+		}
+	})
+
+	t.Run("only the keys of a removed upstream move", func(t *testing.T) {
+		for i := range 1000 {
+			r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/%d", i), nil)
+			before := balancer.Pick(upstreams, r)
+			after := balancer.Pick(upstreams[1:], r)
+			if before != upstreams[0] {
+				assert.Same(t, before, after)
+			}
+		}
+	})
+
+	t.Run("weights", func(t *testing.T) {
+		counts := pickCounts(balancer, newTestUpstreams(t, 3, 1), 4000)
+
+		assert.InDelta(t, 3000, counts["backend-0"], 200)
+	})
+
+	t.Run("header key", func(t *testing.T) {
+		balancer := ConsistentHash(HashByHeader("X-User"))
+		r := httptest.NewRequest(http.MethodGet, "/a", nil)
+		r.Header.Set("X-User", "alice")
+		want := balancer.Pick(upstreams, r)
+		r2 := httptest.NewRequest(http.MethodGet, "/b", nil)
+		r2.Header.Set("X-User", "alice")
+
+		assert.Same(t, want, balancer.Pick(upstreams, r2))
+	})
+}
+
+func TestServiceProxy(t *testing.T) {
+	var upstreams []*Upstream
+	for _, name := range []string{"a", "b"} {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		})
+		defer server.Close()
+		upstream, err := NewUpstream(server.URL, 1)
+		require.NoError(t, err)
+		upstreams = append(upstreams, upstream)
+	}
+	service, err := NewService(upstreams, WithBalancer(RoundRobin()))
+	require.NoError(t, err)
+	proxy, err := NewServiceProxy(service)
+	require.NoError(t, err)
+
+	var bodies []string
+	for range 4 {
+		response := httptest.NewRecorder()
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+		bodies = append(bodies, response.Body.String())
+	}
+
+	assert.Equal(t, []string{"a", "b", "a", "b"}, bodies)
+	assert.Zero(t, upstreams[0].Active())
+}
+
+func TestNewService(t *testing.T) {
+	_, err := NewService(nil)
+	assert.Error(t, err)
+
+	_, err = NewService(newTestUpstreams(t, 1), WithBalancer(nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,235 @@
+package proxycache
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CircuitState is the state of the circuit breaker of an upstream.
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // requests flow
+	CircuitOpen                         // the upstream is ejected
+	CircuitHalfOpen                     // trial requests decide to close or reopen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// CircuitBreaker watches the responses of each upstream of a Service, a
+// transport error or a 5xx status being a failure. An upstream is ejected
+// after ConsecutiveFailures failures in a row, or when more than
+// FailureRatio of at least MinRequests requests fail within Window. After
+// Backoff, it is half-open: HalfOpenRequests trial requests close the
+// circuit when they all succeed, a failure ejects it again for twice the
+// previous backoff, up to MaxBackoff. Zero values get the defaults of
+// DefaultCircuitBreaker, a negative ConsecutiveFailures disables it.
+type CircuitBreaker struct {
+	ConsecutiveFailures int
+	// FailureRatio is between 0 and 1, the ratio is not checked when zero.
+	FailureRatio     float64
+	MinRequests      int
+	Window           time.Duration
+	Backoff          time.Duration
+	MaxBackoff       time.Duration
+	HalfOpenRequests int
+}
+
+// DefaultCircuitBreaker returns the circuit breaker used for the zero
+// fields.
+func DefaultCircuitBreaker() CircuitBreaker {
+	return CircuitBreaker{
+		ConsecutiveFailures: 5,
+		MinRequests:         20,
+		Window:              10 * time.Second,
+		Backoff:             10 * time.Second,
+		MaxBackoff:          5 * time.Minute,
+		HalfOpenRequests:    1,
+	}
+}
+
+// WithCircuitBreaker ejects the failing upstreams of the service from
+// balancing.
+func WithCircuitBreaker(breaker CircuitBreaker) ServiceOptions {
+	return func(s *Service) {
+		defaults := DefaultCircuitBreaker()
+		if breaker.ConsecutiveFailures == 0 {
+			breaker.ConsecutiveFailures = defaults.ConsecutiveFailures
+		}
+		if breaker.MinRequests == 0 {
+			breaker.MinRequests = defaults.MinRequests
+		}
+		if breaker.Window == 0 {
+			breaker.Window = defaults.Window
+		}
+		if breaker.Backoff == 0 {
+			breaker.Backoff = defaults.Backoff
+		}
+		if breaker.MaxBackoff == 0 {
+			breaker.MaxBackoff = max(defaults.MaxBackoff, breaker.Backoff)
+		}
+		if breaker.HalfOpenRequests == 0 {
+			breaker.HalfOpenRequests = defaults.HalfOpenRequests
+		}
+		s.circuitBreaker = &breaker
+	}
+}
+
+func (cb *CircuitBreaker) validate() error {
+	if cb.FailureRatio < 0 || cb.FailureRatio > 1 {
+		return errors.New("invalid circuit breaker: failure ratio must be between 0 and 1")
+	}
+	if cb.Window < 0 || cb.Backoff < 0 || cb.MaxBackoff < cb.Backoff {
+		return errors.New("invalid circuit breaker: negative window or backoff, or max backoff below backoff")
+	}
+	if cb.MinRequests < 0 || cb.HalfOpenRequests < 0 {
+		return errors.New("invalid circuit breaker: negative request count")
+	}
+	return nil
+}
+
+// breaker is the circuit breaker of one upstream.
+type breaker struct {
+	config   *CircuitBreaker
+	upstream *Upstream
+	now      func() time.Time
+
+	mu          sync.Mutex
+	state       CircuitState
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	openUntil   time.Time
+	backoff     time.Duration
+	trials      int // in flight, while half-open
+	successes   int // of the trials
+	ejections   atomic.Int64
+}
+
+func newBreaker(config *CircuitBreaker, upstream *Upstream) *breaker {
+	return &breaker{config: config, upstream: upstream, now: time.Now, backoff: config.Backoff}
+}
+
+// refresh moves an open circuit to half-open once its backoff elapsed.
+func (b *breaker) refresh() CircuitState {
+	if b.state == CircuitOpen && !b.now().Before(b.openUntil) {
+		b.state = CircuitHalfOpen
+		b.trials, b.successes = 0, 0
+		log.Printf("upstream %s circuit is half-open", b.upstream.URL)
+	}
+	return b.state
+}
+
+func (b *breaker) currentState() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.refresh()
+}
+
+// available reports whether a request may be sent, without reserving it.
+func (b *breaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.refresh() {
+	case CircuitClosed:
+		return true
+	case CircuitHalfOpen:
+		return b.trials < b.config.HalfOpenRequests
+	}
+	return false
+}
+
+// acquire reserves a request, which is a trial when the circuit is
+// half-open.
+func (b *breaker) acquire() (trial, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.refresh() {
+	case CircuitClosed:
+		return false, true
+	case CircuitHalfOpen:
+		if b.trials < b.config.HalfOpenRequests {
+			b.trials++
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// release ends a request without outcome, e.g. aborted by its client.
+func (b *breaker) release(trial bool) {
+	if !trial {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trials--
+}
+
+// record ends a request with its outcome.
+func (b *breaker) record(trial, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if trial {
+		b.trials--
+		if b.state != CircuitHalfOpen {
+			return
+		}
+		if failed {
+			b.backoff = min(2*b.backoff, b.config.MaxBackoff)
+			b.open()
+			return
+		}
+		if b.successes++; b.successes >= b.config.HalfOpenRequests {
+			b.close()
+		}
+		return
+	}
+	if b.state != CircuitClosed {
+		return // sent before the circuit opened
+	}
+
+	now := b.now()
+	if now.Sub(b.windowStart) >= b.config.Window {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+	if b.config.ConsecutiveFailures > 0 && b.consecutive >= b.config.ConsecutiveFailures ||
+		b.config.FailureRatio > 0 && b.requests >= b.config.MinRequests &&
+			float64(b.failures)/float64(b.requests) > b.config.FailureRatio {
+		b.open()
+	}
+}
+
+func (b *breaker) open() {
+	b.state = CircuitOpen
+	b.openUntil = b.now().Add(b.backoff)
+	b.ejections.Add(1)
+	log.Printf("upstream %s circuit is open for %v", b.upstream.URL, b.backoff)
+}
+
+func (b *breaker) close() {
+	b.state = CircuitClosed
+	b.backoff = b.config.Backoff
+	b.consecutive, b.requests, b.failures = 0, 0, 0
+	b.windowStart = b.now()
+	log.Printf("upstream %s circuit is closed", b.upstream.URL)
+}
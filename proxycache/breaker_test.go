@@ -0,0 +1,163 @@
+package proxycache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestBreaker(t *testing.T, config CircuitBreaker) (*breaker, *fakeClock) {
+	t.Helper()
+	service, err := NewService(newTestUpstreams(t, 1), WithCircuitBreaker(config))
+	require.NoError(t, err)
+	clock := &fakeClock{now: time.Now()}
+	b := service.upstreams[0].breaker
+	b.now = clock.Now
+	return b, clock
+}
+
+// send records n requests through b.
+func send(t *testing.T, b *breaker, n int, failed bool) {
+	t.Helper()
+	for range n {
+		trial, ok := b.acquire()
+		require.True(t, ok)
+		b.record(trial, failed)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Run("consecutive failures", func(t *testing.T) {
+		b, _ := newTestBreaker(t, CircuitBreaker{ConsecutiveFailures: 3})
+
+		send(t, b, 2, true)
+		send(t, b, 1, false)
+		send(t, b, 2, true)
+		assert.Equal(t, CircuitClosed, b.currentState())
+
+		send(t, b, 1, true)
+		assert.Equal(t, CircuitOpen, b.currentState())
+		assert.False(t, b.available())
+	})
+
+	t.Run("failure ratio", func(t *testing.T) {
+		b, clock := newTestBreaker(t, CircuitBreaker{ConsecutiveFailures: -1, FailureRatio: 0.5, MinRequests: 10, Window: time.Second})
+
+		send(t, b, 5, false)
+		send(t, b, 4, true)
+		clock.now = clock.now.Add(2 * time.Second) // new window
+		send(t, b, 4, false)
+		send(t, b, 5, true)
+		assert.Equal(t, CircuitClosed, b.currentState(), "below min requests")
+
+		send(t, b, 1, true)
+		assert.Equal(t, CircuitOpen, b.currentState())
+	})
+
+	t.Run("half-open", func(t *testing.T) {
+		b, clock := newTestBreaker(t, CircuitBreaker{ConsecutiveFailures: 1, Backoff: time.Second, MaxBackoff: 3 * time.Second, HalfOpenRequests: 2})
+		send(t, b, 1, true)
+
+		clock.now = clock.now.Add(time.Second)
+		assert.Equal(t, CircuitHalfOpen, b.currentState())
+		trial1, _ := b.acquire()
+		trial2, _ := b.acquire()
+		assert.True(t, trial1 && trial2)
+		assert.False(t, b.available(), "trial requests taken")
+
+		b.record(trial1, false)
+		b.record(trial2, true)
+		assert.Equal(t, CircuitOpen, b.currentState())
+
+		clock.now = clock.now.Add(time.Second)
+		assert.Equal(t, CircuitOpen, b.currentState(), "backoff doubled")
+		clock.now = clock.now.Add(time.Second)
+		send(t, b, 1, true)
+		clock.now = clock.now.Add(3 * time.Second)
+		assert.Equal(t, CircuitHalfOpen, b.currentState(), "backoff capped")
+
+		send(t, b, 2, false)
+		assert.Equal(t, CircuitClosed, b.currentState())
+		assert.Equal(t, time.Second, b.backoff)
+		assert.EqualValues(t, 3, b.ejections.Load())
+	})
+
+	t.Run("released trial", func(t *testing.T) {
+		b, clock := newTestBreaker(t, CircuitBreaker{ConsecutiveFailures: 1, Backoff: time.Second})
+		send(t, b, 1, true)
+		clock.now = clock.now.Add(time.Second)
+
+		trial, _ := b.acquire()
+		b.release(trial)
+
+		assert.True(t, b.available())
+	})
+}
+
+func TestServiceCircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+	defer server.Close()
+	upstream, err := NewUpstream(server.URL, 1)
+	require.NoError(t, err)
+	service, err := NewService([]*Upstream{upstream}, WithCircuitBreaker(CircuitBreaker{ConsecutiveFailures: 2, Backoff: 20 * time.Millisecond}))
+	require.NoError(t, err)
+	proxy, err := NewServiceProxy(service)
+	require.NoError(t, err)
+	get := func() int {
+		response := httptest.NewRecorder()
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+		return response.Code
+	}
+
+	assert.Equal(t, http.StatusBadGateway, get())
+	assert.Equal(t, http.StatusBadGateway, get())
+	assert.Equal(t, http.StatusServiceUnavailable, get(), "ejected")
+	assert.Equal(t, CircuitOpen, upstream.CircuitState())
+
+	failing.Store(false)
+	assert.Eventually(t, func() bool { return upstream.CircuitState() == CircuitHalfOpen }, time.Second, time.Millisecond)
+	assert.Equal(t, http.StatusOK, get())
+	assert.Equal(t, CircuitClosed, upstream.CircuitState())
+	assert.EqualValues(t, 3, upstream.Requests())
+	assert.EqualValues(t, 2, upstream.Failures())
+
+	t.Run("metrics", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		response := httptest.NewRecorder()
+
+		NewAdminHandler(NewInMemoryCache(1), "secret", WithAdminServices(map[string]*Service{"web": service})).ServeHTTP(response, request)
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		labels := `{service="web",upstream="` + server.URL + `"}`
+		for _, line := range []string{
+			"# TYPE proxycache_upstream_circuit_state gauge",
+			"proxycache_upstream_circuit_state" + labels + " 0",
+			"proxycache_upstream_healthy" + labels + " 1",
+			"proxycache_upstream_failures_total" + labels + " 2",
+			"proxycache_upstream_ejections_total" + labels + " 1",
+		} {
+			assert.Contains(t, strings.Split(response.Body.String(), "\n"), line)
+		}
+	})
+}
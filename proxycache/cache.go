@@ -0,0 +1,407 @@
+package proxycache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Cache interface {
+	Get(key string) (*CacheEntity, error)
+	Set(key string, value *CacheEntity) error
+}
+
+// TagPurger is implemented by caches keeping a tag-to-keys index, so that
+// entries can be invalidated without knowing their exact URLs.
+type TagPurger interface {
+	// PurgeTag removes every entry tagged with tag and returns how many
+	// entries were removed.
+	PurgeTag(tag string) (int, error)
+}
+
+// PurgeableCache is a Cache that can also be inspected and invalidated,
+// as needed by the admin API.
+type PurgeableCache interface {
+	Cache
+	TagPurger
+	Keys() ([]string, error)
+	Delete(key string) error
+	Clear() error
+}
+
+type CacheEntity struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	URL        string
+	StoredAt   time.Time
+	ExpiresAt  time.Time
+	Tags       []string
+}
+
+// Fresh reports whether the entity can still be served at t. Entities
+// without expiration are heuristically cached and always fresh.
+func (e *CacheEntity) Fresh(t time.Time) bool {
+	return e.ExpiresAt.IsZero() || t.Before(e.ExpiresAt)
+}
+
+// SetCookiePolicy tells the CacheMiddleware what to do with responses
+// carrying a Set-Cookie header.
+type SetCookiePolicy string
+
+const (
+	// SetCookieStrip stores the response without its Set-Cookie headers.
+	SetCookieStrip SetCookiePolicy = "strip"
+	// SetCookieBypass does not store the response at all.
+	SetCookieBypass SetCookiePolicy = "bypass"
+)
+
+type cacheOptions struct {
+	setCookie    SetCookiePolicy
+	tagHeader    string
+	detachedFill time.Duration
+	purge        purgeOptions
+}
+
+type CacheOptions func(*cacheOptions)
+
+// WithSetCookiePolicy configures how responses with Set-Cookie are stored.
+// Defaults to SetCookieStrip.
+func WithSetCookiePolicy(policy SetCookiePolicy) CacheOptions {
+	return func(o *cacheOptions) {
+		o.setCookie = policy
+	}
+}
+
+// WithTagHeader sets the response header listing the cache tags (or
+// surrogate keys) of a response, e.g. "Surrogate-Key" or "Cache-Tag".
+func WithTagHeader(name string) CacheOptions {
+	return func(o *cacheOptions) {
+		o.tagHeader = name
+	}
+}
+
+// WithDetachedFill lets cache fills finish, within timeout, even after their
+// client went away. The upstream request is then no longer cancelled with
+// the client one.
+func WithDetachedFill(timeout time.Duration) CacheOptions {
+	return func(o *cacheOptions) {
+		o.detachedFill = timeout
+	}
+}
+
+func CacheMiddleware(cache Cache, options ...CacheOptions) Middleware {
+	opts := &cacheOptions{setCookie: SetCookieStrip}
+	for _, option := range options {
+		option(opts)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if handlePurge(w, r, cache, &opts.purge) {
+				return
+			}
+			if upgradeType(r.Header) != "" {
+				// a protocol upgrade, e.g. a WebSocket, is never cached and
+				// needs the connection of the client
+				setCacheStatus(w, statusBYPASS)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			etag := getETag(r)
+			cacheable := !bypassCacheFromRequest(w, r)
+			if cacheable {
+				cached, _ := cache.Get(etag)
+				if cached != nil && cached.Fresh(time.Now()) {
+					setHeaders(w.Header(), cached.Header)
+					setCacheStatus(w, statusHIT)
+					setEtagHeader(w, etag)
+					w.WriteHeader(cached.StatusCode)
+					w.Write(cached.Body)
+					return
+				}
+			}
+
+			rec := &responseRecorder{ResponseWriter: w, body: bytes.NewBuffer(nil)}
+			// decided with the response headers, so that the client sees
+			// MISS or BYPASS
+			rec.beforeHeader = func() {
+				if rec.store = !bypassCacheFromResponse(rec, r, opts); rec.store {
+					setEtagHeader(w, etag)
+					setCacheStatus(w, statusMISS)
+				}
+			}
+			if cacheable && opts.detachedFill > 0 {
+				// the fill outlives its client, so that a response
+				// abandoned half-way still ends up cached
+				ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), opts.detachedFill)
+				defer cancel()
+				r = r.WithContext(ctx)
+				rec.detached = true
+			}
+			next.ServeHTTP(rec, r)
+			if rec.detached && r.Context().Err() != nil {
+				log.Printf("cache fill timed out: %s %s", r.Method, r.URL.String())
+				return
+			}
+
+			if rec.store {
+				header := rec.Header().Clone()
+				// shared caches must not hand out one client's cookies to another
+				header.Del("Set-Cookie")
+				now := time.Now()
+				entity := &CacheEntity{
+					StatusCode: rec.statusCode,
+					Header:     header,
+					Body:       rec.body.Bytes(),
+					URL:        r.URL.String(),
+					StoredAt:   now,
+					ExpiresAt:  expiresAt(rec.Header(), now),
+				}
+				if opts.tagHeader != "" {
+					entity.Tags = parseTags(rec.Header().Values(opts.tagHeader))
+				}
+				cache.Set(etag, entity)
+			}
+		})
+	}
+}
+
+func bypassCacheFromRequest(w http.ResponseWriter, r *http.Request) bool {
+	rules := []string{"no-store", "no-cache", "private"}     // bypass
+	methodRules := []string{http.MethodGet, http.MethodHead} // allow
+	directives := parseCacheControl(r.Header)
+	for _, rule := range rules {
+		if _, ok := directives[rule]; ok {
+			setCacheStatus(w, statusBYPASS)
+			return true
+		}
+	}
+
+	if !slices.Contains(methodRules, r.Method) {
+		setCacheStatus(w, statusBYPASS)
+		return true
+	}
+	return false
+}
+
+func bypassCacheFromResponse(rec *responseRecorder, r *http.Request, opts *cacheOptions) bool {
+	cacheControlRules := []string{"no-store", "no-cache", "private"}               // bypass
+	authorizationRules := []string{"public", "must-revalidate", "s-maxage"}        // allow - ref. RFC9111 3.5
+	methodRules := []string{http.MethodGet, http.MethodHead}                       // allow
+	codeRules := []int{200, 203, 204, 206, 300, 301, 308, 404, 405, 410, 414, 501} // allow - ref. RFC9110 15.1
+	if rec.Header().Get("X-Cache-Status") == statusBYPASS.String() {
+		// was bypassed by request => wanted ?? doubt
+		return true
+	}
+	directives := parseCacheControl(rec.Header())
+	for _, rule := range cacheControlRules {
+		// By default, Cache-Control empty = heuristic caching
+		if _, ok := directives[rule]; ok {
+			setCacheStatus(rec, statusBYPASS)
+			return true
+		}
+	}
+
+	if r.Header.Get("Authorization") != "" && !slices.ContainsFunc(authorizationRules, func(rule string) bool {
+		_, ok := directives[rule]
+		return ok
+	}) {
+		setCacheStatus(rec, statusBYPASS)
+		return true
+	}
+
+	if _, ok := directives["must-revalidate"]; ok && expiresAt(rec.Header(), time.Now()).IsZero() {
+		// stored without expiration, it would be served forever without the
+		// revalidation this cache cannot do, e.g. to clients without the
+		// Authorization that allowed storing it
+		setCacheStatus(rec, statusBYPASS)
+		return true
+	}
+
+	if opts.setCookie == SetCookieBypass && len(rec.Header().Values("Set-Cookie")) > 0 {
+		setCacheStatus(rec, statusBYPASS)
+		return true
+	}
+
+	if !slices.Contains(methodRules, r.Method) {
+		setCacheStatus(rec, statusBYPASS)
+		return true
+	}
+
+	if !slices.Contains(codeRules, rec.statusCode) {
+		// TODO: add more tests for this
+		setCacheStatus(rec, statusBYPASS)
+		return true
+	}
+	return false
+}
+
+// parseCacheControl returns the Cache-Control directives of h, keyed by
+// their lowercased name. Directives without argument map to "".
+func parseCacheControl(h http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return directives
+}
+
+// expiresAt computes when a response stored at now stops being fresh, from
+// s-maxage, max-age or Expires in that order. It returns the zero time when
+// none is set, and now for an invalid Expires, e.g. "0", which means
+// already expired (RFC 9111 §5.3).
+func expiresAt(h http.Header, now time.Time) time.Time {
+	directives := parseCacheControl(h)
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if arg, ok := directives[directive]; ok {
+			if seconds, err := strconv.Atoi(arg); err == nil {
+				return now.Add(time.Duration(seconds) * time.Second)
+			}
+		}
+	}
+	if _, ok := h["Expires"]; !ok {
+		return time.Time{}
+	}
+	if expires, err := http.ParseTime(h.Get("Expires")); err == nil {
+		return expires
+	}
+	return now
+}
+
+// parseTags splits tag header values on commas and whitespace, which covers
+// both the Surrogate-Key and the Cache-Tag formats.
+func parseTags(values []string) []string {
+	var tags []string
+	for _, value := range values {
+		for _, tag := range strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		}) {
+			if !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+type cacheStatus string
+
+func (c cacheStatus) String() string {
+	return string(c)
+}
+
+const (
+	statusBYPASS cacheStatus = "BYPASS"
+	statusHIT    cacheStatus = "HIT"
+	statusMISS   cacheStatus = "MISS"
+)
+
+func setCacheStatus(w http.ResponseWriter, status cacheStatus) {
+	log.Printf("cache status: %v", status)
+	w.Header().Set("X-Cache-Status", status.String())
+}
+
+func setEtagHeader(w http.ResponseWriter, etag string) {
+	w.Header().Set("Etag", etag)
+}
+
+// getETag returns the cache key of r. It includes the Host and the route,
+// as a router can send the requests of several sites and services through
+// the same cache, and the scheme, as origins often redirect http requests
+// to https.
+func getETag(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	route, _ := r.Context().Value(routeScopeKey{}).(string)
+	return base64.StdEncoding.EncodeToString([]byte(r.Method + ":" + route + ":" + scheme + "://" + r.Host + r.URL.RequestURI()))
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       *bytes.Buffer
+
+	// beforeHeader runs once before the headers are sent, and decides
+	// whether to store the response
+	beforeHeader func()
+	store        bool
+
+	// detached recorders keep recording once the client is gone
+	detached   bool
+	clientGone bool
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+		if r.beforeHeader != nil {
+			r.beforeHeader()
+		}
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.body.Write(b)
+	if r.clientGone {
+		return len(b), nil
+	}
+	n, err := r.ResponseWriter.Write(b)
+	if err != nil && r.detached {
+		r.clientGone = true
+		return len(b), nil
+	}
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	r.FlushError()
+}
+
+func (r *responseRecorder) FlushError() error {
+	if r.statusCode == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.clientGone {
+		return nil
+	}
+	err := http.NewResponseController(r.ResponseWriter).Flush()
+	if err != nil && r.detached && !errors.Is(err, http.ErrNotSupported) {
+		r.clientGone = true
+		return nil
+	}
+	return err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Hijack lets the handlers type asserting http.Hijacker take over the
+// connection. Nothing is recorded afterwards.
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
@@ -0,0 +1,575 @@
+package proxycache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type StubCache struct {
+	store    map[string]*CacheEntity
+	getCalls int
+	getError error
+	setCalls int
+	setError error
+}
+
+func newStubCache(store map[string]*CacheEntity, get, set error) *StubCache {
+	if store == nil {
+		store = map[string]*CacheEntity{}
+	}
+	return &StubCache{store, 0, get, 0, set}
+}
+
+func (c *StubCache) Get(key string) (*CacheEntity, error) {
+	c.getCalls++
+	return c.store[key], c.getError
+}
+
+func (c *StubCache) Set(key string, value *CacheEntity) error {
+	c.setCalls++
+	c.store[key] = value
+	return c.setError
+}
+
+func TestCache(t *testing.T) {
+	t.Run("GET request cached on first call", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "first response")
+		})
+		defer server.Close()
+		cache := newStubCache(nil, errors.New("not found"), nil)
+		cacheMiddleware := CacheMiddleware(cache)
+		proxy := newTestProxy(t, server.URL, WithMiddlewares(cacheMiddleware))
+		request := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		response := httptest.NewRecorder()
+		expected := &CacheEntity{
+			StatusCode: 200,
+			Body:       []byte("first response"),
+		}
+
+		proxy.ServeHTTP(response, request)
+
+		assert.Equal(t, "MISS", response.Header().Get("X-Cache-Status"))
+		assert.Equal(t, 1, cache.getCalls)
+		assert.Equal(t, 1, cache.setCalls)
+		cached := cache.store[response.Header().Get("ETag")]
+		require.NotNil(t, cached) // TODO, WIP
+		assert.Equal(t, expected.StatusCode, cached.StatusCode)
+		assert.Equal(t, string(expected.Body), string(cached.Body))
+		assert.NotEmpty(t, cached.Header) // TODO
+	})
+
+	t.Run("return the cached response", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "real response")
+		})
+		defer server.Close()
+		request := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		response := httptest.NewRecorder()
+		store := map[string]*CacheEntity{
+			getETag(request): {
+				StatusCode: 200,
+				Header:     http.Header{},
+				Body:       []byte("cached response"),
+				ExpiresAt:  time.Now().Add(time.Minute),
+			},
+		}
+		cache := newStubCache(store, nil, nil)
+		proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(cache)))
+
+		proxy.ServeHTTP(response, request)
+
+		assert.Equal(t, "HIT", response.Header().Get("X-Cache-Status"))
+		assert.Equal(t, 1, cache.getCalls)
+		assert.Equal(t, 0, cache.setCalls)
+		assert.Equal(t, "cached response", response.Body.String())
+	})
+
+	t.Run("multi-valued headers replayed on HIT", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Link", "</style.css>; rel=preload")
+			w.Header().Add("Link", "</app.js>; rel=preload")
+			fmt.Fprintf(w, "real response")
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(newStubCache(nil, nil, nil))))
+		proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, server.URL, nil))
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, server.URL, nil))
+
+		assert.Equal(t, "HIT", response.Header().Get("X-Cache-Status"))
+		assert.Equal(t, []string{"</style.css>; rel=preload", "</app.js>; rel=preload"}, response.Header().Values("Link"))
+	})
+
+	t.Run("stale response is refreshed", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			fmt.Fprintf(w, "real response")
+		})
+		defer server.Close()
+		request := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		response := httptest.NewRecorder()
+		store := map[string]*CacheEntity{
+			getETag(request): {
+				StatusCode: 200,
+				Header:     http.Header{},
+				Body:       []byte("cached response"),
+				ExpiresAt:  time.Now().Add(-time.Minute),
+			},
+		}
+		cache := newStubCache(store, nil, nil)
+		proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(cache)))
+
+		proxy.ServeHTTP(response, request)
+
+		assert.Equal(t, "MISS", response.Header().Get("X-Cache-Status"))
+		assert.Equal(t, "real response", response.Body.String())
+		cached := cache.store[getETag(request)]
+		assert.WithinDuration(t, time.Now().Add(time.Minute), cached.ExpiresAt, time.Second)
+	})
+}
+
+func TestCacheScheme(t *testing.T) {
+	server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(HeaderForwardedProto) == "http" {
+			http.Redirect(w, r, "https://"+r.Host+r.URL.Path, http.StatusMovedPermanently)
+			return
+		}
+		fmt.Fprintf(w, "secure response")
+	})
+	defer server.Close()
+	proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(NewInMemoryCache(10))))
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+	response := httptest.NewRecorder()
+
+	proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "https://example.com/page", nil))
+
+	assert.Equal(t, http.StatusOK, response.Code, "http redirect not replayed over TLS")
+	assert.Equal(t, "secure response", response.Body.String())
+}
+
+func TestExpiresAt(t *testing.T) {
+	now := time.Date(2025, time.January, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc   string
+		header http.Header
+		want   time.Time
+	}{
+		{desc: "none", header: http.Header{}, want: time.Time{}},
+		{desc: "s-maxage first", header: http.Header{"Cache-Control": {"max-age=60, s-maxage=10"}}, want: now.Add(10 * time.Second)},
+		{desc: "max-age over Expires", header: http.Header{"Cache-Control": {"max-age=60"}, "Expires": {"0"}}, want: now.Add(time.Minute)},
+		{desc: "Expires", header: http.Header{"Expires": {"Wed, 01 Jan 2025 13:00:00 GMT"}}, want: now.Add(time.Hour)},
+		{desc: "invalid Expires", header: http.Header{"Expires": {"0"}}, want: now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := expiresAt(tt.header, now)
+
+			assert.True(t, tt.want.Equal(got), "got %v", got)
+		})
+	}
+
+	t.Run("invalid Expires is stale", func(t *testing.T) {
+		entity := &CacheEntity{ExpiresAt: expiresAt(http.Header{"Expires": {"0"}}, now)}
+
+		assert.False(t, entity.Fresh(now))
+	})
+}
+
+func TestNoCache(t *testing.T) {
+	tests := []struct {
+		desc            string
+		method          string
+		requestHeaders  http.Header
+		responseHeaders http.Header
+		body            io.Reader
+		wantCached      bool
+	}{
+		{
+			desc:   "Cache-Control: no-cache",
+			method: http.MethodGet,
+			requestHeaders: http.Header{
+				"Cache-Control": {"no-cache"},
+			},
+			responseHeaders: http.Header{
+				"Cache-Control": {"no-cache"},
+			},
+		},
+		{
+			desc:   "Cache-Control: no-store",
+			method: http.MethodGet,
+			requestHeaders: http.Header{
+				"Cache-Control": {"no-store"},
+			},
+			responseHeaders: http.Header{
+				"Cache-Control": {"no-store"},
+			},
+		},
+		{
+			desc:   "Cache-Control: private",
+			method: http.MethodGet,
+			requestHeaders: http.Header{
+				"Cache-Control": {"private"},
+			},
+			responseHeaders: http.Header{
+				"Cache-Control": {"private"},
+			},
+		},
+		{
+			desc:   "Cache-Control: public",
+			method: http.MethodGet,
+			requestHeaders: http.Header{
+				"Cache-Control": {"public"},
+			},
+			responseHeaders: http.Header{
+				"Cache-Control": {"public"},
+			},
+			wantCached: true,
+		},
+		{
+			desc:   "Cache-Control: max-ages",
+			method: http.MethodGet,
+			requestHeaders: http.Header{
+				"Cache-Control": {"max-age=86400"},
+			},
+			responseHeaders: http.Header{
+				"Cache-Control": {"max-age=86400"},
+			},
+			wantCached: true,
+		},
+		{
+			desc:   "Cache-Control: public,max-ages",
+			method: http.MethodGet,
+			requestHeaders: http.Header{
+				"Cache-Control": {"public", "max-age=86400"},
+			},
+			responseHeaders: http.Header{
+				"Cache-Control": {"public", "max-age=86400"},
+			},
+			wantCached: true,
+		},
+		{
+			desc:   "Cache-Control: private,max-ages",
+			method: http.MethodGet,
+			requestHeaders: http.Header{
+				"Cache-Control": {"private", "max-age=86400"},
+			},
+			responseHeaders: http.Header{
+				"Cache-Control": {"private", "max-age=86400"},
+			},
+			wantCached: false,
+		},
+		{
+			desc:       "Cache for GET",
+			method:     http.MethodGet,
+			wantCached: true,
+		},
+		{
+			desc:       "Cache for HEAD",
+			method:     http.MethodHead,
+			wantCached: true,
+		},
+		{
+			desc:       "No cache for OPTIONS",
+			method:     http.MethodOptions,
+			wantCached: false,
+		},
+		{
+			desc:       "No cache for TRACE",
+			method:     http.MethodTrace,
+			wantCached: false,
+		},
+		{
+			desc:       "No cache for POST",
+			method:     http.MethodPost,
+			wantCached: false,
+		},
+		{
+			desc:       "No cache for PUT",
+			method:     http.MethodPut,
+			wantCached: false,
+		},
+		{
+			desc:       "No cache for PATCH",
+			method:     http.MethodPatch,
+			wantCached: false,
+		},
+		{
+			desc:       "No cache for DELETE",
+			method:     http.MethodDelete,
+			wantCached: false,
+		},
+		{
+			desc:   "Bypassed by request, no cache-control on response",
+			method: http.MethodGet, // this would allow the caching
+			requestHeaders: http.Header{
+				"Cache-Control": []string{"private", "no-cache"},
+			},
+			wantCached: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+				addHeaders(w.Header(), tt.responseHeaders)
+			})
+			defer server.Close()
+			cache := newStubCache(map[string]*CacheEntity{}, nil, nil)
+			proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(cache)))
+			response := httptest.NewRecorder()
+			request := httptest.NewRequest(tt.method, server.URL, tt.body)
+			addHeaders(request.Header, tt.requestHeaders)
+
+			proxy.ServeHTTP(response, request)
+
+			if tt.wantCached {
+				assert.Equal(t, 1, cache.getCalls, "cache get calls")
+				assert.Equal(t, 1, cache.setCalls, "cache set calls")
+				assert.NotEmpty(t, response.Header().Get("ETag"))
+				assert.Equal(t, "MISS", response.Header().Get("X-Cache-Status"))
+				return
+			}
+			assert.Equal(t, 0, cache.getCalls, "cache get calls")
+			assert.Equal(t, 0, cache.setCalls, "cache set calls")
+			assert.Empty(t, response.Header().Get("ETag"))
+			assert.Equal(t, "BYPASS", response.Header().Get("X-Cache-Status"))
+		})
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	tests := []struct {
+		desc            string
+		responseHeaders http.Header
+		wantCached      bool
+	}{
+		{
+			desc: "no Cache-Control",
+		},
+		{
+			desc: "Cache-Control: max-age",
+			responseHeaders: http.Header{
+				"Cache-Control": {"max-age=86400"},
+			},
+		},
+		{
+			desc: "Cache-Control: public",
+			responseHeaders: http.Header{
+				"Cache-Control": {"public"},
+			},
+			wantCached: true,
+		},
+		{
+			desc: "Cache-Control: must-revalidate without expiration",
+			responseHeaders: http.Header{
+				"Cache-Control": {"must-revalidate"},
+			},
+		},
+		{
+			desc: "Cache-Control: must-revalidate",
+			responseHeaders: http.Header{
+				"Cache-Control": {"must-revalidate, max-age=60"},
+			},
+			wantCached: true,
+		},
+		{
+			desc: "Cache-Control: s-maxage",
+			responseHeaders: http.Header{
+				"Cache-Control": {"max-age=60, s-maxage=86400"},
+			},
+			wantCached: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+				addHeaders(w.Header(), tt.responseHeaders)
+			})
+			defer server.Close()
+			cache := newStubCache(nil, nil, nil)
+			proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(cache)))
+			response := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, server.URL, nil)
+			request.Header.Set("Authorization", "Bearer token")
+
+			proxy.ServeHTTP(response, request)
+
+			setCalls := cache.setCalls
+			anonymous := httptest.NewRecorder()
+			proxy.ServeHTTP(anonymous, httptest.NewRequest(http.MethodGet, server.URL, nil))
+
+			if tt.wantCached {
+				assert.Equal(t, 1, setCalls, "cache set calls")
+				assert.Equal(t, "MISS", response.Header().Get("X-Cache-Status"))
+				assert.Equal(t, "HIT", anonymous.Header().Get("X-Cache-Status"), "shared with clients without Authorization")
+				return
+			}
+			assert.Equal(t, 0, setCalls, "cache set calls")
+			assert.Equal(t, "BYPASS", response.Header().Get("X-Cache-Status"))
+			assert.NotEqual(t, "HIT", anonymous.Header().Get("X-Cache-Status"), "not shared with clients without Authorization")
+		})
+	}
+}
+
+func TestSetCookie(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("X-Other", "kept")
+		fmt.Fprint(w, "body")
+	}
+
+	t.Run("stripped from the stored headers by default", func(t *testing.T) {
+		server := createTestServer(handler)
+		defer server.Close()
+		cache := newStubCache(nil, nil, nil)
+		proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(cache)))
+		request := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, request)
+
+		assert.Equal(t, "session=secret", response.Header().Get("Set-Cookie"))
+		cached := cache.store[getETag(request)]
+		require.NotNil(t, cached)
+		assert.Empty(t, cached.Header.Values("Set-Cookie"))
+		assert.Equal(t, "kept", cached.Header.Get("X-Other"))
+	})
+
+	t.Run("not replayed on HIT", func(t *testing.T) {
+		server := createTestServer(handler)
+		defer server.Close()
+		cache := newStubCache(nil, nil, nil)
+		proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(cache)))
+
+		proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, server.URL, nil))
+		response := httptest.NewRecorder()
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, server.URL, nil))
+
+		assert.Equal(t, "HIT", response.Header().Get("X-Cache-Status"))
+		assert.Empty(t, response.Header().Get("Set-Cookie"))
+		assert.Equal(t, "kept", response.Header().Get("X-Other"))
+	})
+
+	t.Run("bypass policy", func(t *testing.T) {
+		server := createTestServer(handler)
+		defer server.Close()
+		cache := newStubCache(nil, nil, nil)
+		proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(cache, WithSetCookiePolicy(SetCookieBypass))))
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, server.URL, nil))
+
+		assert.Equal(t, 0, cache.setCalls)
+		assert.Equal(t, "BYPASS", response.Header().Get("X-Cache-Status"))
+		assert.Equal(t, "session=secret", response.Header().Get("Set-Cookie"))
+	})
+}
+
+func TestCacheTags(t *testing.T) {
+	server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Surrogate-Key", "product-1 products")
+		w.Header().Add("Surrogate-Key", "home,products")
+		fmt.Fprint(w, "product page")
+	})
+	defer server.Close()
+	cache := NewInMemoryCache(10)
+	proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(cache, WithTagHeader("Surrogate-Key"))))
+	request := httptest.NewRequest(http.MethodGet, server.URL, nil)
+
+	proxy.ServeHTTP(httptest.NewRecorder(), request)
+
+	cached, _ := cache.Get(getETag(request))
+	require.NotNil(t, cached)
+	assert.Equal(t, []string{"product-1", "products", "home"}, cached.Tags)
+
+	n, err := cache.PurgeTag("products")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	response := httptest.NewRecorder()
+	proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, server.URL, nil))
+	assert.Equal(t, "MISS", response.Header().Get("X-Cache-Status"))
+}
+
+func TestDetachedFill(t *testing.T) {
+	tests := []struct {
+		desc       string
+		options    []CacheOptions
+		wantCached bool
+	}{
+		{
+			desc: "fill cancelled with its client",
+		},
+		{
+			desc:       "detached fill outlives its client",
+			options:    []CacheOptions{WithDetachedFill(time.Second)},
+			wantCached: true,
+		},
+		{
+			desc:    "detached fill timeout",
+			options: []CacheOptions{WithDetachedFill(10 * time.Millisecond)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(50 * time.Millisecond):
+				}
+				fmt.Fprint(w, "slow response")
+			})
+			defer server.Close()
+			cache := NewInMemoryCache(10)
+			proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(cache, tt.options...)))
+			ctx, cancel := context.WithCancel(context.Background())
+			request := httptest.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+			time.AfterFunc(5*time.Millisecond, cancel)
+
+			proxy.ServeHTTP(httptest.NewRecorder(), request)
+
+			cached, _ := cache.Get(getETag(request))
+			if !tt.wantCached {
+				assert.Nil(t, cached)
+				return
+			}
+			require.NotNil(t, cached)
+			assert.Equal(t, "slow response", string(cached.Body))
+		})
+	}
+}
+
+func TestDetachedFillClientGone(t *testing.T) {
+	server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "full response")
+	})
+	defer server.Close()
+	cache := NewInMemoryCache(10)
+	proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(cache, WithDetachedFill(time.Second))))
+	request := httptest.NewRequest(http.MethodGet, server.URL, nil)
+
+	proxy.ServeHTTP(&brokenWriter{httptest.NewRecorder()}, request)
+
+	cached, _ := cache.Get(getETag(request))
+	require.NotNil(t, cached)
+	assert.Equal(t, "full response", string(cached.Body))
+}
+
+// brokenWriter fails every write, like the connection of a gone client.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w *brokenWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
@@ -0,0 +1,114 @@
+package proxycache
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// CertificateFiles are the PEM files of a certificate, with its chain, and
+// of its private key.
+type CertificateFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Certificates picks the certificate of the TLS handshakes by server name
+// (SNI), among certificates loaded from files. They can be reloaded, e.g.
+// once renewed, without dropping the established connections: only the
+// next handshakes use the new ones.
+type Certificates struct {
+	files        []CertificateFiles
+	certificates atomic.Pointer[[]tls.Certificate]
+	modTimes     []time.Time
+}
+
+// LoadCertificates loads the certificates of files. The first one is
+// served to the clients sending no server name, or one matching none of
+// the certificates.
+func LoadCertificates(files ...CertificateFiles) (*Certificates, error) {
+	if len(files) == 0 {
+		return nil, errors.New("invalid certificates: none")
+	}
+	c := &Certificates{files: files}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificates from their files again. When one of them
+// is invalid, the current ones are kept.
+func (c *Certificates) Reload() error {
+	certificates := make([]tls.Certificate, 0, len(c.files))
+	for _, files := range c.files {
+		certificate, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return fmt.Errorf("invalid certificate %s: %w", files.CertFile, err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	c.certificates.Store(&certificates)
+	return nil
+}
+
+// GetCertificate returns the certificate of a handshake, for
+// tls.Config.GetCertificate.
+func (c *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificates := *c.certificates.Load()
+	for i := range certificates {
+		if hello.SupportsCertificate(&certificates[i]) == nil {
+			return &certificates[i], nil
+		}
+	}
+	return &certificates[0], nil
+}
+
+// Watch reloads the certificates when their files change, checking every
+// interval until ctx is done.
+func (c *Certificates) Watch(ctx context.Context, interval time.Duration) {
+	c.modTimes = c.stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		modTimes := c.stat()
+		if slices.Equal(modTimes, c.modTimes) {
+			continue
+		}
+		// retried on the next change only, files are often written in
+		// several steps
+		c.modTimes = modTimes
+		if err := c.Reload(); err != nil {
+			log.Printf("error reloading TLS certificates: %v", err)
+			continue
+		}
+		log.Printf("TLS certificates reloaded")
+	}
+}
+
+// stat returns the modification times of the files, zero for the missing
+// ones.
+func (c *Certificates) stat() []time.Time {
+	var modTimes []time.Time
+	for _, files := range c.files {
+		for _, name := range []string{files.CertFile, files.KeyFile} {
+			var modTime time.Time
+			if info, err := os.Stat(name); err == nil {
+				modTime = info.ModTime()
+			}
+			modTimes = append(modTimes, modTime)
+		}
+	}
+	return modTimes
+}
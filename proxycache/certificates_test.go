@@ -0,0 +1,172 @@
+package proxycache
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCertificate writes a self-signed certificate for names to dir and
+// returns its files. name is used as the common name, telling the
+// certificates apart.
+func writeCertificate(t *testing.T, dir, name string, names ...string) CertificateFiles {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	files := CertificateFiles{CertFile: filepath.Join(dir, name+".pem"), KeyFile: filepath.Join(dir, name+".key")}
+	require.NoError(t, os.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return files
+}
+
+// serveTLS echoes the TLS connections of a loopback listener
+// using certificates and returns its address.
+func serveTLS(t *testing.T, certificates *Certificates) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: certificates.GetCertificate})
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// servedCertificate connects to addr with serverName and returns the common
+// name of the certificate served.
+func servedCertificate(t *testing.T, addr, serverName string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertificates(t *testing.T) {
+	t.Run("SNI", func(t *testing.T) {
+		dir := t.TempDir()
+		certificates, err := LoadCertificates(
+			writeCertificate(t, dir, "default", "example.com"),
+			writeCertificate(t, dir, "api", "api.example.com"),
+			writeCertificate(t, dir, "wildcard", "*.example.com"),
+		)
+		require.NoError(t, err)
+		addr := serveTLS(t, certificates)
+
+		tests := []struct {
+			serverName string
+			want       string
+		}{
+			{serverName: "example.com", want: "default"},
+			{serverName: "api.example.com", want: "api"},
+			{serverName: "API.example.com", want: "api"},
+			{serverName: "web.example.com", want: "wildcard"},
+			{serverName: "other.org", want: "default"},
+			{serverName: "", want: "default"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.serverName, func(t *testing.T) {
+				assert.Equal(t, tt.want, servedCertificate(t, addr, tt.serverName))
+			})
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		dir := t.TempDir()
+		files := writeCertificate(t, dir, "old", "example.com")
+		certificates, err := LoadCertificates(files)
+		require.NoError(t, err)
+		addr := serveTLS(t, certificates)
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, err)
+		defer conn.Close()
+
+		renewed := writeCertificate(t, dir, "new", "example.com")
+		require.NoError(t, os.Rename(renewed.CertFile, files.CertFile))
+		require.NoError(t, os.Rename(renewed.KeyFile, files.KeyFile))
+		require.NoError(t, certificates.Reload())
+
+		assert.Equal(t, "new", servedCertificate(t, addr, "example.com"))
+		_, err = io.WriteString(conn, "still open\n")
+		require.NoError(t, err)
+		line := make([]byte, len("still open\n"))
+		_, err = io.ReadFull(conn, line)
+		require.NoError(t, err)
+		assert.Equal(t, "still open\n", string(line), "established connection kept")
+	})
+
+	t.Run("invalid reload", func(t *testing.T) {
+		files := writeCertificate(t, t.TempDir(), "old", "example.com")
+		certificates, err := LoadCertificates(files)
+		require.NoError(t, err)
+
+		require.NoError(t, os.WriteFile(files.KeyFile, []byte("not a key"), 0o600))
+
+		assert.ErrorContains(t, certificates.Reload(), "invalid certificate")
+		assert.Equal(t, "old", servedCertificate(t, serveTLS(t, certificates), "example.com"))
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		dir := t.TempDir()
+		files := writeCertificate(t, dir, "old", "example.com")
+		certificates, err := LoadCertificates(files)
+		require.NoError(t, err)
+		addr := serveTLS(t, certificates)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go certificates.Watch(ctx, 10*time.Millisecond)
+		time.Sleep(50 * time.Millisecond) // let Watch read the modification times
+
+		renewed := writeCertificate(t, dir, "new", "example.com")
+		require.NoError(t, os.Rename(renewed.CertFile, files.CertFile))
+		require.NoError(t, os.Rename(renewed.KeyFile, files.KeyFile))
+
+		assert.Eventually(t, func() bool { return servedCertificate(t, addr, "example.com") == "new" }, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestLoadCertificates(t *testing.T) {
+	_, err := LoadCertificates()
+	assert.ErrorContains(t, err, "none")
+	_, err = LoadCertificates(CertificateFiles{CertFile: "missing.pem", KeyFile: "missing.key"})
+	assert.ErrorContains(t, err, "invalid certificate missing.pem")
+	_, err = LoadCertificates(CertificateFiles{CertFile: "../demo/cert.pem", KeyFile: "../demo/key.pem"})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,14 @@
+// Package proxycache provides an HTTP reverse proxy with caching.
+//
+// A Proxy forwards requests to an origin server through a chain of
+// Middleware, such as the one returned by CacheMiddleware:
+//
+//	cache := proxycache.NewInMemoryCache(1024)
+//	proxy, err := proxycache.NewProxy("http://localhost:8000",
+//		proxycache.WithMiddlewares(proxycache.CacheMiddleware(cache)),
+//	)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	http.ListenAndServe(":5000", proxy)
+package proxycache
@@ -0,0 +1,155 @@
+package proxycache
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// ErrorReason tells why the Proxy could not get a response from upstream.
+type ErrorReason string
+
+const (
+	ReasonRequest    ErrorReason = "request"     // the client request could not be forwarded
+	ReasonDial       ErrorReason = "dial"        // the upstream could not be reached
+	ReasonReset      ErrorReason = "reset"       // the upstream closed the connection
+	ReasonTimeout    ErrorReason = "timeout"     // the upstream did not answer in time
+	ReasonTLS        ErrorReason = "tls"         // the TLS handshake with the upstream failed
+	ReasonNoUpstream ErrorReason = "no_upstream" // no upstream of the service is available
+	ReasonUpgrade    ErrorReason = "upgrade"     // the protocol upgrade could not be proxied
+	ReasonUnknown    ErrorReason = "unknown"
+)
+
+// ProxyError is the error given to the ErrorHandler.
+type ProxyError struct {
+	StatusCode int
+	Reason     ErrorReason
+	Err        error
+}
+
+func (e *ProxyError) Error() string {
+	return string(e.Reason) + ": " + e.Err.Error()
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorHandler writes the response sent to the client when the Proxy fails
+// to get one from upstream. err is a *ProxyError.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// WithErrorHandler replaces DefaultErrorHandler, e.g. with
+// ProblemDetailsErrorHandler or to render branded error pages.
+func WithErrorHandler(handler ErrorHandler) ProxyOptions {
+	return func(p *Proxy) {
+		p.errorHandler = handler
+	}
+}
+
+// DefaultErrorHandler answers with the status code of the error and its
+// status text.
+func DefaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	code := errorStatusCode(err)
+	http.Error(w, http.StatusText(code), code)
+}
+
+// ProblemDetails is the JSON body of ProblemDetailsErrorHandler.
+// ref. RFC9457
+type ProblemDetails struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+var reasonDetails = map[ErrorReason]string{
+	ReasonRequest:    "The request could not be forwarded to the upstream server.",
+	ReasonDial:       "The upstream server could not be reached.",
+	ReasonReset:      "The upstream server closed the connection.",
+	ReasonTimeout:    "The upstream server did not answer in time.",
+	ReasonTLS:        "The TLS handshake with the upstream server failed.",
+	ReasonNoUpstream: "No upstream server is available.",
+	ReasonUpgrade:    "The protocol upgrade could not be proxied.",
+}
+
+// ProblemDetailsErrorHandler answers with an application/problem+json body.
+// The underlying error is not exposed to the client.
+func ProblemDetailsErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	code := errorStatusCode(err)
+	problem := ProblemDetails{
+		Type:   "about:blank",
+		Title:  http.StatusText(code),
+		Status: code,
+	}
+	var proxyErr *ProxyError
+	if errors.As(err, &proxyErr) {
+		problem.Reason = string(proxyErr.Reason)
+		problem.Detail = reasonDetails[proxyErr.Reason]
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(problem); err != nil {
+		log.Printf("error encoding problem details: %v", err)
+	}
+}
+
+func errorStatusCode(err error) int {
+	var proxyErr *ProxyError
+	if errors.As(err, &proxyErr) {
+		return proxyErr.StatusCode
+	}
+	return http.StatusBadGateway
+}
+
+// newUpstreamError classifies an error of the upstream round trip.
+func newUpstreamError(err error) *ProxyError {
+	reason := upstreamErrorReason(err)
+	code := http.StatusBadGateway
+	if reason == ReasonTimeout {
+		code = http.StatusGatewayTimeout
+	}
+	return &ProxyError{StatusCode: code, Reason: reason, Err: err}
+}
+
+func upstreamErrorReason(err error) ErrorReason {
+	var netErr net.Error
+	var opErr *net.OpError
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ReasonTimeout
+	case errors.As(err, &recordErr),
+		errors.As(err, &certErr),
+		errors.As(err, &alertErr),
+		errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr),
+		errors.As(err, &invalidErr):
+		return ReasonTLS
+	case errors.As(err, &opErr) && opErr.Op == "dial",
+		errors.Is(err, syscall.ECONNREFUSED):
+		return ReasonDial
+	case errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return ReasonReset
+	}
+	return ReasonUnknown
+}
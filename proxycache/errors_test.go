@@ -0,0 +1,105 @@
+package proxycache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamErrors(t *testing.T) {
+	closed := createTestServer(func(w http.ResponseWriter, r *http.Request) {})
+	closed.Close()
+	reset := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		conn.Close()
+	})
+	defer reset.Close()
+	slow := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	defer slow.Close()
+	untrusted := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer untrusted.Close()
+
+	tests := []struct {
+		desc       string
+		origin     string
+		options    []ProxyOptions
+		wantCode   int
+		wantReason ErrorReason
+	}{
+		{
+			desc:       "connection refused",
+			origin:     closed.URL,
+			wantCode:   http.StatusBadGateway,
+			wantReason: ReasonDial,
+		},
+		{
+			desc:       "connection reset",
+			origin:     reset.URL,
+			wantCode:   http.StatusBadGateway,
+			wantReason: ReasonReset,
+		},
+		{
+			desc:       "timeout",
+			origin:     slow.URL,
+			options:    []ProxyOptions{WithUpstreamTimeout(10 * time.Millisecond)},
+			wantCode:   http.StatusGatewayTimeout,
+			wantReason: ReasonTimeout,
+		},
+		{
+			desc:       "untrusted certificate",
+			origin:     untrusted.URL,
+			wantCode:   http.StatusBadGateway,
+			wantReason: ReasonTLS,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var got error
+			handler := func(w http.ResponseWriter, r *http.Request, err error) {
+				got = err
+				DefaultErrorHandler(w, r, err)
+			}
+			proxy := newTestProxy(t, tt.origin, append(tt.options, WithErrorHandler(handler))...)
+			response := httptest.NewRecorder()
+
+			proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			assert.Equal(t, tt.wantCode, response.Code)
+			assert.Equal(t, http.StatusText(tt.wantCode)+"\n", response.Body.String())
+			var proxyErr *ProxyError
+			require.ErrorAs(t, got, &proxyErr)
+			assert.Equal(t, tt.wantReason, proxyErr.Reason)
+		})
+	}
+}
+
+func TestProblemDetailsErrorHandler(t *testing.T) {
+	closed := createTestServer(func(w http.ResponseWriter, r *http.Request) {})
+	closed.Close()
+	proxy := newTestProxy(t, closed.URL, WithErrorHandler(ProblemDetailsErrorHandler))
+	response := httptest.NewRecorder()
+
+	proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusBadGateway, response.Code)
+	assert.Equal(t, "application/problem+json", response.Header().Get("Content-Type"))
+	var problem ProblemDetails
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&problem))
+	assert.Equal(t, ProblemDetails{
+		Type:   "about:blank",
+		Title:  "Bad Gateway",
+		Status: http.StatusBadGateway,
+		Detail: "The upstream server could not be reached.",
+		Reason: "dial",
+	}, problem)
+}
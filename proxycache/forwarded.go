@@ -0,0 +1,140 @@
+package proxycache
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+const (
+	HeaderForwarded    = "Forwarded"
+	HeaderForwardedFor = "X-Forwarded-For"
+	HeaderRealIP       = "X-Real-Ip"
+)
+
+// forwardedHeaders are the headers a client may use to spoof its origin,
+// they are only kept from trusted proxies.
+var forwardedHeaders = []string{
+	HeaderForwarded,
+	HeaderForwardedFor,
+	HeaderForwardedHost,
+	HeaderForwardedPort,
+	HeaderForwardedProto,
+	HeaderForwardedServer,
+	HeaderForwardedPrefix,
+	HeaderRealIP,
+}
+
+// WithTrustedProxies sets the networks of the proxies in front of this one.
+// Forwarded headers are appended to when coming from them, and stripped
+// otherwise.
+func WithTrustedProxies(networks ...netip.Prefix) ProxyOptions {
+	return func(p *Proxy) {
+		p.trustedProxies = append(p.trustedProxies, networks...)
+	}
+}
+
+// setForwardedHeaders sets the X-Forwarded-* and Forwarded headers of r,
+// before it is sent to the origin.
+func (p *Proxy) setForwardedHeaders(r *http.Request) error {
+	var client netip.Addr
+	if r.RemoteAddr != "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return fmt.Errorf("error reading address: %w", err)
+		}
+		client, err = netip.ParseAddr(host)
+		if err != nil {
+			return fmt.Errorf("error reading address: %w", err)
+		}
+		client = client.Unmap()
+	}
+
+	trusted := client.IsValid() && slices.ContainsFunc(p.trustedProxies, func(network netip.Prefix) bool {
+		return network.Contains(client)
+	})
+	if !trusted {
+		for _, name := range forwardedHeaders {
+			r.Header.Del(name)
+		}
+		prefixes, _ := r.Context().Value(strippedPrefixesKey{}).([]string)
+		for _, prefix := range prefixes {
+			r.Header.Add(HeaderForwardedPrefix, prefix)
+		}
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	setDefaultHeader(r.Header, HeaderForwardedProto, proto)
+	setDefaultHeader(r.Header, HeaderForwardedHost, r.Host)
+	setDefaultHeader(r.Header, HeaderForwardedPort, forwardedPort(r, proto))
+	r.Header.Set(HeaderForwardedServer, "ProxyCache") // WIP
+
+	if !client.IsValid() {
+		return nil
+	}
+	appendHeader(r.Header, HeaderForwardedFor, client.String())
+	setDefaultHeader(r.Header, HeaderRealIP, client.String())
+	appendHeader(r.Header, HeaderForwarded, forwardedElement(client, r.Host, proto))
+	return nil
+}
+
+// forwardedPort returns the port the client connected to, from the Host
+// header or else the listener address.
+func forwardedPort(r *http.Request, proto string) string {
+	if _, port, err := net.SplitHostPort(r.Host); err == nil && port != "" {
+		return port
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	if proto == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// forwardedElement formats one hop of the Forwarded header. ref. RFC7239 4
+func forwardedElement(client netip.Addr, host, proto string) string {
+	node := client.String()
+	if client.Is6() {
+		node = `"[` + node + `]"`
+	}
+	element := "for=" + node
+	if host != "" {
+		element += ";host=" + forwardedValue(host)
+	}
+	return element + ";proto=" + proto
+}
+
+// forwardedValue quotes v when it is not a valid token.
+func forwardedValue(v string) string {
+	if strings.ContainsFunc(v, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r))
+	}) {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+	}
+	return v
+}
+
+// setDefaultHeader sets the header key to value unless already present.
+func setDefaultHeader(h http.Header, key, value string) {
+	if h.Get(key) == "" {
+		h.Set(key, value)
+	}
+}
+
+// appendHeader appends value to the comma separated list of key.
+func appendHeader(h http.Header, key, value string) {
+	if prior := h.Values(key); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	h.Set(key, value)
+}
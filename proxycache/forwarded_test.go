@@ -0,0 +1,137 @@
+package proxycache
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	spoofed := http.Header{
+		HeaderForwarded:      {"for=1.1.1.1"},
+		HeaderForwardedFor:   {"1.1.1.1"},
+		HeaderForwardedHost:  {"spoofed.example.com"},
+		HeaderForwardedPort:  {"1234"},
+		HeaderForwardedProto: {"https"},
+		HeaderRealIP:         {"1.1.1.1"},
+	}
+	tests := []struct {
+		desc       string
+		remoteAddr string
+		host       string
+		header     http.Header
+		tls        bool
+		localAddr  net.Addr
+		want       http.Header
+	}{
+		{
+			desc:       "direct client",
+			remoteAddr: "192.0.2.1:1234",
+			host:       "example.com",
+			want: http.Header{
+				HeaderForwarded:      {"for=192.0.2.1;host=example.com;proto=http"},
+				HeaderForwardedFor:   {"192.0.2.1"},
+				HeaderForwardedHost:  {"example.com"},
+				HeaderForwardedPort:  {"80"},
+				HeaderForwardedProto: {"http"},
+				HeaderRealIP:         {"192.0.2.1"},
+			},
+		},
+		{
+			desc:       "TLS client",
+			remoteAddr: "192.0.2.1:1234",
+			host:       "example.com",
+			tls:        true,
+			want: http.Header{
+				HeaderForwarded:      {"for=192.0.2.1;host=example.com;proto=https"},
+				HeaderForwardedPort:  {"443"},
+				HeaderForwardedProto: {"https"},
+			},
+		},
+		{
+			desc:       "port from the listener",
+			remoteAddr: "192.0.2.1:1234",
+			host:       "example.com",
+			localAddr:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000},
+			want: http.Header{
+				HeaderForwardedPort: {"5000"},
+			},
+		},
+		{
+			desc:       "IPv6 client and host with port",
+			remoteAddr: "[2001:db8::1]:1234",
+			host:       "example.com:8080",
+			want: http.Header{
+				HeaderForwarded:     {`for="[2001:db8::1]";host="example.com:8080";proto=http`},
+				HeaderForwardedFor:  {"2001:db8::1"},
+				HeaderForwardedPort: {"8080"},
+			},
+		},
+		{
+			desc:       "untrusted peer headers are stripped",
+			remoteAddr: "192.0.2.1:1234",
+			host:       "example.com",
+			header:     spoofed,
+			want: http.Header{
+				HeaderForwarded:      {"for=192.0.2.1;host=example.com;proto=http"},
+				HeaderForwardedFor:   {"192.0.2.1"},
+				HeaderForwardedHost:  {"example.com"},
+				HeaderForwardedPort:  {"80"},
+				HeaderForwardedProto: {"http"},
+				HeaderRealIP:         {"192.0.2.1"},
+			},
+		},
+		{
+			desc:       "trusted peer headers are appended to",
+			remoteAddr: "10.0.0.2:1234",
+			host:       "example.com",
+			header:     spoofed,
+			want: http.Header{
+				HeaderForwarded:      {"for=1.1.1.1, for=10.0.0.2;host=example.com;proto=http"},
+				HeaderForwardedFor:   {"1.1.1.1, 10.0.0.2"},
+				HeaderForwardedHost:  {"spoofed.example.com"},
+				HeaderForwardedPort:  {"1234"},
+				HeaderForwardedProto: {"https"},
+				HeaderRealIP:         {"1.1.1.1"},
+			},
+		},
+		{
+			desc:       "no remote address",
+			remoteAddr: "",
+			host:       "example.com",
+			want: http.Header{
+				HeaderForwardedFor: nil,
+				HeaderRealIP:       nil,
+				HeaderForwarded:    nil,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			proxy := newTestProxy(t, "http://origin.test", WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8")))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Host = tt.host
+			addHeaders(req.Header, tt.header)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if tt.localAddr != nil {
+				req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, tt.localAddr))
+			}
+
+			err := proxy.setForwardedHeaders(req)
+
+			assert.NoError(t, err)
+			for name, values := range tt.want {
+				assert.Equal(t, values, req.Header.Values(name), name)
+			}
+		})
+	}
+}
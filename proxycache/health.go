@@ -0,0 +1,182 @@
+package proxycache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheck probes the upstreams of a Service periodically. An upstream
+// failing UnhealthyThreshold probes in a row is taken out of balancing,
+// until it passes HealthyThreshold probes in a row. Zero values get the
+// defaults of DefaultHealthCheck.
+type HealthCheck struct {
+	// Path is requested with GET, relative to the base path of the
+	// upstream URL. tcp upstreams are only connected to, udp ones cannot
+	// be probed.
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// Status is the expected status code, any 2xx or 3xx when zero.
+	Status             int
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	// Transport sends the probes, http.DefaultTransport when nil.
+	Transport http.RoundTripper
+}
+
+// DefaultHealthCheck returns the health check used for the zero fields.
+func DefaultHealthCheck() HealthCheck {
+	return HealthCheck{
+		Path:               "/",
+		Interval:           10 * time.Second,
+		Timeout:            2 * time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+}
+
+// WithHealthCheck probes the upstreams of the service, see
+// Service.RunHealthChecks.
+func WithHealthCheck(check HealthCheck) ServiceOptions {
+	return func(s *Service) {
+		defaults := DefaultHealthCheck()
+		if check.Path == "" {
+			check.Path = defaults.Path
+		}
+		if check.Interval == 0 {
+			check.Interval = defaults.Interval
+		}
+		if check.Timeout == 0 {
+			check.Timeout = defaults.Timeout
+		}
+		if check.HealthyThreshold == 0 {
+			check.HealthyThreshold = defaults.HealthyThreshold
+		}
+		if check.UnhealthyThreshold == 0 {
+			check.UnhealthyThreshold = defaults.UnhealthyThreshold
+		}
+		if check.Transport == nil {
+			check.Transport = http.DefaultTransport
+		}
+		s.healthCheck = &check
+	}
+}
+
+func (check *HealthCheck) validate(upstreams []*Upstream) error {
+	if check.Interval < 0 || check.Timeout < 0 {
+		return errors.New("invalid health check: negative interval or timeout")
+	}
+	if check.HealthyThreshold < 0 || check.UnhealthyThreshold < 0 {
+		return errors.New("invalid health check: negative threshold")
+	}
+	for _, upstream := range upstreams {
+		switch upstream.URL.Scheme {
+		case schemeH2C:
+			if _, err := h2cTransport(check.Transport); err != nil {
+				return fmt.Errorf("invalid health check: %w", err)
+			}
+		case schemeUDP:
+			return fmt.Errorf("invalid health check: udp upstream %s cannot be probed", upstream.URL)
+		}
+	}
+	return nil
+}
+
+// RunHealthChecks probes the upstreams every interval until ctx is done.
+// It returns immediately when the service has no health check.
+func (s *Service) RunHealthChecks(ctx context.Context) {
+	if s.healthCheck == nil {
+		return
+	}
+	client := s.healthCheck.client(s.healthCheck.Transport)
+	var h2cClient *http.Client
+	if s.h2c() {
+		transport, _ := h2cTransport(s.healthCheck.Transport) // validated
+		h2cClient = s.healthCheck.client(transport)
+	}
+	var wg sync.WaitGroup
+	for _, upstream := range s.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if upstream.URL.Scheme == schemeH2C {
+				s.healthCheck.run(ctx, h2cClient, upstream)
+			} else {
+				s.healthCheck.run(ctx, client, upstream)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (check *HealthCheck) client(transport http.RoundTripper) *http.Client {
+	client := newClient(transport)
+	client.Timeout = check.Timeout
+	return client
+}
+
+func (check *HealthCheck) run(ctx context.Context, client *http.Client, upstream *Upstream) {
+	ticker := time.NewTicker(check.Interval)
+	defer ticker.Stop()
+	var successes, failures int
+	for {
+		if err := check.probe(ctx, client, upstream); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			successes, failures = 0, failures+1
+			if failures >= check.UnhealthyThreshold && upstream.unhealthy.CompareAndSwap(false, true) {
+				log.Printf("upstream %s is unhealthy: %v", upstream.URL, err)
+			}
+		} else {
+			successes, failures = successes+1, 0
+			if successes >= check.HealthyThreshold && upstream.unhealthy.CompareAndSwap(true, false) {
+				log.Printf("upstream %s is healthy", upstream.URL)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (check *HealthCheck) probe(ctx context.Context, client *http.Client, upstream *Upstream) error {
+	if upstream.URL.Scheme == schemeTCP {
+		dialer := &net.Dialer{Timeout: check.Timeout}
+		conn, err := dialer.DialContext(ctx, "tcp", upstream.URL.Host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	u := *upstream.URL
+	u.Scheme = upstreamScheme(&u)
+	u.Path = singleJoiningSlash(u.Path, check.Path)
+	u.RawPath = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) // reuse the connection
+
+	if check.Status != 0 && resp.StatusCode != check.Status ||
+		check.Status == 0 && (resp.StatusCode < 200 || resp.StatusCode >= 400) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
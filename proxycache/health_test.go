@@ -0,0 +1,104 @@
+package proxycache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheck(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	var probes atomic.Int32
+	server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/healthz" {
+			probes.Add(1)
+			w.WriteHeader(int(status.Load()))
+		}
+	})
+	defer server.Close()
+	upstream, err := NewUpstream(server.URL+"/api", 1)
+	require.NoError(t, err)
+	service, err := NewService([]*Upstream{upstream}, WithHealthCheck(HealthCheck{
+		Path:               "/healthz",
+		Interval:           5 * time.Millisecond,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 2,
+	}))
+	require.NoError(t, err)
+	proxy, err := NewServiceProxy(service)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		service.RunHealthChecks(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return probes.Load() >= 2 }, time.Second, time.Millisecond)
+	assert.True(t, upstream.Healthy())
+
+	status.Store(http.StatusServiceUnavailable)
+	assert.Eventually(t, func() bool { return !upstream.Healthy() }, time.Second, time.Millisecond)
+	response := httptest.NewRecorder()
+	proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+
+	status.Store(http.StatusOK)
+	assert.Eventually(t, upstream.Healthy, time.Second, time.Millisecond)
+	response = httptest.NewRecorder()
+	proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	cancel()
+	<-done
+}
+
+func TestHealthCheckStatus(t *testing.T) {
+	server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer server.Close()
+	upstream, err := NewUpstream(server.URL, 1)
+	require.NoError(t, err)
+	client := &http.Client{}
+
+	for _, tt := range []struct {
+		status  int
+		healthy bool
+	}{
+		{status: 0, healthy: true},
+		{status: http.StatusNoContent, healthy: true},
+		{status: http.StatusOK, healthy: false},
+	} {
+		check := &HealthCheck{Path: "/", Status: tt.status}
+
+		err := check.probe(context.Background(), client, upstream)
+
+		assert.Equal(t, tt.healthy, err == nil, "status %d", tt.status)
+	}
+}
+
+func TestServiceWithoutHealthyUpstream(t *testing.T) {
+	upstreams := newTestUpstreams(t, 1, 1)
+	upstreams[0].unhealthy.Store(true)
+	service, err := NewService(upstreams)
+	require.NoError(t, err)
+
+	for range 3 {
+		lease, err := service.pick(httptest.NewRequest(http.MethodGet, "/", nil))
+		require.NoError(t, err)
+		assert.Same(t, upstreams[1], lease.upstream)
+		lease.release(outcomeSuccess)
+	}
+
+	upstreams[1].unhealthy.Store(true)
+	_, err = service.pick(httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.ErrorIs(t, err, ErrNoUpstream)
+}
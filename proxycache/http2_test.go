@@ -0,0 +1,131 @@
+package proxycache
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// protoHandler answers with the protocol of the request, streamed in two
+// flushed chunks, and with a trailer.
+func protoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Trailer", "X-Proto")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, r.Proto)
+	http.NewResponseController(w).Flush()
+	io.WriteString(w, " ok")
+	w.Header().Set("X-Proto", r.Proto)
+}
+
+// newH2CServer starts a server accepting cleartext HTTP/2 only.
+func newH2CServer(handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server
+}
+
+// h2cClient returns a client speaking cleartext HTTP/2 with prior knowledge.
+func h2cClient() *http.Client {
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: transport}
+}
+
+func TestHTTP2(t *testing.T) {
+	get := func(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+		t.Helper()
+		resp, err := client.Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	t.Run("h2c upstream", func(t *testing.T) {
+		upstream := newH2CServer(http.HandlerFunc(protoHandler))
+		defer upstream.Close()
+		proxy := newTestProxy(t, strings.Replace(upstream.URL, "http://", "h2c://", 1))
+		server := httptest.NewServer(proxy)
+		defer server.Close()
+
+		resp, body := get(t, server.Client(), server.URL)
+
+		assert.Equal(t, "HTTP/2.0 ok", body)
+		assert.Equal(t, "HTTP/2.0", resp.Trailer.Get("X-Proto"))
+	})
+
+	t.Run("h2c upstream health check", func(t *testing.T) {
+		upstream := newH2CServer(http.HandlerFunc(protoHandler))
+		defer upstream.Close()
+		h2c, err := NewUpstream(strings.Replace(upstream.URL, "http://", "h2c://", 1), 1)
+		require.NoError(t, err)
+		service, err := NewService([]*Upstream{h2c}, WithHealthCheck(HealthCheck{Interval: time.Millisecond, HealthyThreshold: 1}))
+		require.NoError(t, err)
+		h2c.unhealthy.Store(true)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go service.RunHealthChecks(ctx)
+
+		assert.Eventually(t, h2c.Healthy, time.Second, time.Millisecond)
+	})
+
+	t.Run("TLS upstream", func(t *testing.T) {
+		upstream := httptest.NewUnstartedServer(http.HandlerFunc(protoHandler))
+		upstream.EnableHTTP2 = true
+		upstream.StartTLS()
+		defer upstream.Close()
+		transport := NewTransport(TransportOptions{TLSClientConfig: &tls.Config{RootCAs: upstream.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}})
+		proxy := newTestProxy(t, upstream.URL, WithTransport(transport))
+		server := httptest.NewServer(proxy)
+		defer server.Close()
+
+		_, body := get(t, server.Client(), server.URL)
+
+		assert.Equal(t, "HTTP/2.0 ok", body)
+	})
+
+	t.Run("h2c listener", func(t *testing.T) {
+		upstream := createTestServer(protoHandler)
+		defer upstream.Close()
+		cache := NewInMemoryCache(10)
+		server := newH2CServer(newTestProxy(t, upstream.URL, WithMiddlewares(CacheMiddleware(cache))))
+		defer server.Close()
+
+		resp, body := get(t, h2cClient(), server.URL)
+
+		assert.Equal(t, 2, resp.ProtoMajor)
+		assert.Equal(t, "HTTP/1.1 ok", body)
+		assert.Equal(t, "HTTP/1.1", resp.Trailer.Get("X-Proto"))
+	})
+
+	t.Run("TLS listener through the cache", func(t *testing.T) {
+		upstream := createTestServer(protoHandler)
+		defer upstream.Close()
+		cache := NewInMemoryCache(10)
+		server := httptest.NewUnstartedServer(newTestProxy(t, upstream.URL, WithMiddlewares(CacheMiddleware(cache))))
+		server.EnableHTTP2 = true
+		server.StartTLS()
+		defer server.Close()
+
+		for _, hit := range []bool{false, true} {
+			resp, body := get(t, server.Client(), server.URL)
+
+			assert.Equal(t, 2, resp.ProtoMajor)
+			assert.Equal(t, hit, resp.Header.Get("X-Cache-Status") == "HIT")
+			assert.Equal(t, "HTTP/1.1 ok", body)
+			assert.Equal(t, "HTTP/1.1", resp.Trailer.Get("X-Proto"))
+		}
+	})
+}
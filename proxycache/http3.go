@@ -0,0 +1,23 @@
+package proxycache
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// AltSvcMiddleware advertises the HTTP/3 endpoint of server with the
+// Alt-Svc header, on the responses to the requests received over TLS and
+// TCP, so that the clients switch to QUIC for the next ones. server then
+// serves the same handler, without this middleware.
+func AltSvcMiddleware(server *http3.Server) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil && r.ProtoMajor < 3 {
+				// fails until server listens, there is nothing to advertise yet
+				server.SetQUICHeaders(w.Header())
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package proxycache
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newHTTP3Server serves handler over QUIC on a loopback UDP port, with the
+// certificate of the httptest TLS servers, and returns a client for it.
+func newHTTP3Server(t *testing.T, handler http.Handler) (*http3.Server, string, *http.Client) {
+	t.Helper()
+	tcp := httptest.NewTLSServer(handler) // for its certificate and client
+	t.Cleanup(tcp.Close)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	server := &http3.Server{Handler: handler, TLSConfig: tcp.TLS.Clone()}
+	go server.Serve(conn)
+	t.Cleanup(func() { server.Close() })
+	require.Eventually(t, func() bool {
+		return server.SetQUICHeaders(http.Header{}) == nil // listening
+	}, time.Second, time.Millisecond)
+
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: tcp.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}}
+	t.Cleanup(func() { transport.Close() })
+	return server, "https://" + conn.LocalAddr().String(), &http.Client{Transport: transport}
+}
+
+func TestHTTP3(t *testing.T) {
+	t.Run("through the cache", func(t *testing.T) {
+		var forwardedProto string
+		upstream := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			forwardedProto = r.Header.Get(HeaderForwardedProto)
+			protoHandler(w, r)
+		})
+		defer upstream.Close()
+		cache := NewInMemoryCache(10)
+		proxy := newTestProxy(t, upstream.URL, WithMiddlewares(CacheMiddleware(cache)))
+		_, url, client := newHTTP3Server(t, proxy)
+
+		for _, hit := range []bool{false, true} {
+			resp, err := client.Get(url)
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, 3, resp.ProtoMajor)
+			assert.Equal(t, hit, resp.Header.Get("X-Cache-Status") == "HIT")
+			assert.Equal(t, "HTTP/1.1 ok", string(body))
+			assert.Equal(t, "HTTP/1.1", resp.Trailer.Get("X-Proto"))
+		}
+		assert.Equal(t, "https", forwardedProto)
+	})
+
+	t.Run("truncated response", func(t *testing.T) {
+		upstream := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "100")
+			io.WriteString(w, "partial")
+			http.NewResponseController(w).Flush()
+			panic(http.ErrAbortHandler)
+		})
+		defer upstream.Close()
+		_, url, client := newHTTP3Server(t, newTestProxy(t, upstream.URL))
+
+		resp, err := client.Get(url)
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		assert.Error(t, err, "the stream is reset")
+	})
+
+	t.Run("Alt-Svc", func(t *testing.T) {
+		h3, url, _ := newHTTP3Server(t, http.NotFoundHandler())
+		_, port, err := net.SplitHostPort(url[len("https://"):])
+		require.NoError(t, err)
+		handler := AltSvcMiddleware(h3)(http.NotFoundHandler())
+
+		request := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		assert.Equal(t, `h3=":`+port+`"; ma=2592000`, response.Header().Get("Alt-Svc"))
+
+		request = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		response = httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		assert.Empty(t, response.Header().Get("Alt-Svc"), "not over TLS")
+	})
+}
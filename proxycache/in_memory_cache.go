@@ -0,0 +1,88 @@
+package proxycache
+
+import "sync"
+
+type InMemoryCache struct {
+	store map[string]*CacheEntity
+	tags  map[string]map[string]struct{} // tag -> keys
+	mu    sync.RWMutex
+}
+
+func NewInMemoryCache(size int) *InMemoryCache {
+	c := new(InMemoryCache)
+	c.store = make(map[string]*CacheEntity, size)
+	c.tags = make(map[string]map[string]struct{})
+	return c
+}
+
+func (c *InMemoryCache) Get(key string) (*CacheEntity, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	val := c.store[key]
+	return val, nil
+}
+
+func (c *InMemoryCache) Set(key string, value *CacheEntity) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delete(key)
+	c.store[key] = value
+	for _, tag := range value.Tags {
+		if c.tags[tag] == nil {
+			c.tags[tag] = make(map[string]struct{})
+		}
+		c.tags[tag][key] = struct{}{}
+	}
+	return nil
+}
+
+func (c *InMemoryCache) PurgeTag(tag string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := c.tags[tag]
+	n := len(keys)
+	for key := range keys {
+		c.delete(key)
+	}
+	return n, nil
+}
+
+func (c *InMemoryCache) Keys() ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make([]string, 0, len(c.store))
+	for key := range c.store {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (c *InMemoryCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delete(key)
+	return nil
+}
+
+func (c *InMemoryCache) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.store)
+	clear(c.tags)
+	return nil
+}
+
+// delete removes key from the store and the tag index, c.mu must be held.
+func (c *InMemoryCache) delete(key string) {
+	entity, ok := c.store[key]
+	if !ok {
+		return
+	}
+	for _, tag := range entity.Tags {
+		delete(c.tags[tag], key)
+		if len(c.tags[tag]) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+	delete(c.store, key)
+}
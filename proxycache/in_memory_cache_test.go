@@ -0,0 +1,63 @@
+package proxycache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryCache(t *testing.T) {
+	t.Run("set and get", func(t *testing.T) {
+		cache := NewInMemoryCache(10)
+		entity := &CacheEntity{StatusCode: 200, Body: []byte("content")}
+
+		require.NoError(t, cache.Set("key", entity))
+		got, err := cache.Get("key")
+
+		require.NoError(t, err)
+		assert.Equal(t, entity, got)
+	})
+
+	t.Run("purge by tag", func(t *testing.T) {
+		cache := NewInMemoryCache(10)
+		cache.Set("product-1", &CacheEntity{Tags: []string{"product", "p1"}})
+		cache.Set("product-2", &CacheEntity{Tags: []string{"product", "p2"}})
+		cache.Set("home", &CacheEntity{Tags: []string{"home"}})
+
+		n, err := cache.PurgeTag("product")
+
+		require.NoError(t, err)
+		assert.Equal(t, 2, n)
+		for _, key := range []string{"product-1", "product-2"} {
+			got, _ := cache.Get(key)
+			assert.Nil(t, got, key)
+		}
+		got, _ := cache.Get("home")
+		assert.NotNil(t, got)
+		assert.NotContains(t, cache.tags, "p1")
+	})
+
+	t.Run("overwriting an entry updates the tag index", func(t *testing.T) {
+		cache := NewInMemoryCache(10)
+		cache.Set("key", &CacheEntity{Tags: []string{"old"}})
+		cache.Set("key", &CacheEntity{Tags: []string{"new"}})
+
+		n, _ := cache.PurgeTag("old")
+		assert.Equal(t, 0, n)
+		got, _ := cache.Get("key")
+		assert.NotNil(t, got)
+
+		n, _ = cache.PurgeTag("new")
+		assert.Equal(t, 1, n)
+	})
+
+	t.Run("unknown tag", func(t *testing.T) {
+		cache := NewInMemoryCache(10)
+
+		n, err := cache.PurgeTag("unknown")
+
+		require.NoError(t, err)
+		assert.Equal(t, 0, n)
+	})
+}
@@ -0,0 +1,57 @@
+package proxycache
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// upstreamMetrics are the metrics of each upstream, in the Prometheus text
+// exposition format.
+var upstreamMetrics = []struct {
+	name  string
+	kind  string
+	help  string
+	value func(*Upstream) int64
+}{
+	{"proxycache_upstream_healthy", "gauge", "Whether the upstream passes its active health checks.", func(u *Upstream) int64 { return boolMetric(u.Healthy()) }},
+	{"proxycache_upstream_circuit_state", "gauge", "State of the circuit breaker: 0 closed, 1 open, 2 half-open.", func(u *Upstream) int64 { return int64(u.CircuitState()) }},
+	{"proxycache_upstream_active_requests", "gauge", "Requests in flight to the upstream.", (*Upstream).Active},
+	{"proxycache_upstream_requests_total", "counter", "Requests sent to the upstream.", (*Upstream).Requests},
+	{"proxycache_upstream_failures_total", "counter", "Requests failing with a transport error or a 5xx status.", (*Upstream).Failures},
+	{"proxycache_upstream_ejections_total", "counter", "Times the circuit breaker ejected the upstream.", (*Upstream).Ejections},
+}
+
+func (a *admin) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeUpstreamMetrics(w, a.services)
+}
+
+func writeUpstreamMetrics(w io.Writer, services map[string]*Service) {
+	names := slices.Sorted(maps.Keys(services))
+	for _, metric := range upstreamMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, name := range names {
+			for _, upstream := range services[name].Upstreams() {
+				fmt.Fprintf(w, "%s{service=%s,upstream=%s} %d\n", metric.name,
+					labelValue(name), labelValue(upstream.URL.String()), metric.value(upstream))
+			}
+		}
+	}
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(value string) string {
+	return `"` + labelReplacer.Replace(value) + `"`
+}
+
+func boolMetric(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,597 @@
+package proxycache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/netip"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+type Proxy struct {
+	service     *Service
+	middlewares []Middleware
+	transport   http.RoundTripper
+	client      *http.Client
+	h2cClient   *http.Client
+
+	trustedProxies     []netip.Prefix
+	flushInterval      time.Duration
+	upstreamTimeout    time.Duration
+	retry              *retrier
+	upgradeIdleTimeout time.Duration
+	errorHandler       ErrorHandler
+	http.Handler
+}
+
+type ProxyOptions func(*Proxy)
+
+type Middleware func(http.Handler) http.Handler
+
+func chain(middlewares ...Middleware) Middleware {
+	return func(next http.Handler) http.Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+const (
+	HeaderForwardedHost   = "X-Forwarded-Host"
+	HeaderForwardedPort   = "X-Forwarded-Port"
+	HeaderForwardedProto  = "X-Forwarded-Proto"
+	HeaderForwardedServer = "X-Forwarded-Server"
+)
+
+// NewProxy returns a reverse proxy to origin, an absolute http, https or h2c
+// URL. It fails when origin or one of the options is invalid.
+func NewProxy(origin string, options ...ProxyOptions) (*Proxy, error) {
+	upstream, err := NewUpstream(origin, 1)
+	if err != nil {
+		return nil, err
+	}
+	service, err := NewService([]*Upstream{upstream})
+	if err != nil {
+		return nil, err
+	}
+	return NewServiceProxy(service, options...)
+}
+
+// NewServiceProxy returns a reverse proxy balancing the requests among the
+// upstreams of service.
+func NewServiceProxy(service *Service, options ...ProxyOptions) (*Proxy, error) {
+	if service == nil {
+		return nil, errors.New("invalid service: nil")
+	}
+	if err := service.checkSchemes("http", "https", schemeH2C); err != nil {
+		return nil, err
+	}
+	proxy := new(Proxy)
+	proxy.service = service
+	proxy.transport = NewTransport(DefaultTransportOptions())
+	proxy.errorHandler = DefaultErrorHandler
+
+	for _, option := range options {
+		option(proxy)
+	}
+	if err := proxy.validate(); err != nil {
+		return nil, err
+	}
+	proxy.client = newClient(proxy.transport)
+	if service.h2c() {
+		transport, err := h2cTransport(proxy.transport)
+		if err != nil {
+			return nil, err
+		}
+		proxy.h2cClient = newClient(transport)
+	}
+
+	proxy.Handler = chain(proxy.middlewares...)(proxy.callServer())
+
+	return proxy, nil
+}
+
+func parseOrigin(origin string) (*url.URL, error) {
+	o, err := url.Parse(origin)
+	if err != nil {
+		return nil, fmt.Errorf("invalid origin %q: %w", origin, err)
+	}
+	switch o.Scheme {
+	case "http", "https", schemeH2C:
+	case schemeTCP, schemeUDP:
+		if o.Port() == "" {
+			return nil, fmt.Errorf("invalid origin %q: missing port", origin)
+		}
+	default:
+		return nil, fmt.Errorf("invalid origin %q: scheme must be http, https, h2c, tcp or udp", origin)
+	}
+	if o.Host == "" {
+		return nil, fmt.Errorf("invalid origin %q: missing host", origin)
+	}
+	return o, nil
+}
+
+func (p *Proxy) validate() error {
+	if p.transport == nil {
+		return errors.New("invalid transport: nil")
+	}
+	if p.errorHandler == nil {
+		return errors.New("invalid error handler: nil")
+	}
+	if p.upstreamTimeout < 0 {
+		return fmt.Errorf("invalid upstream timeout %v: must not be negative", p.upstreamTimeout)
+	}
+	for _, network := range p.trustedProxies {
+		if !network.IsValid() {
+			return fmt.Errorf("invalid trusted proxy network %v", network)
+		}
+	}
+	if p.retry != nil {
+		if err := p.retry.policy.validate(); err != nil {
+			return err
+		}
+	}
+	for _, middleware := range p.middlewares {
+		if middleware == nil {
+			return errors.New("invalid middleware: nil")
+		}
+	}
+	return nil
+}
+
+func WithMiddlewares(middlewares ...Middleware) ProxyOptions {
+	return func(p *Proxy) {
+		p.middlewares = append(p.middlewares, middlewares...)
+	}
+}
+
+// WithUpstreamTimeout sets a deadline for the whole upstream exchange, from
+// the request to the end of the response body.
+func WithUpstreamTimeout(timeout time.Duration) ProxyOptions {
+	return func(p *Proxy) {
+		p.upstreamTimeout = timeout
+	}
+}
+
+func (p *Proxy) callServer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the upstream request is bound to the client one, so that it is
+		// cancelled when the client goes away
+		ctx := r.Context()
+		if p.upstreamTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, p.upstreamTimeout)
+			defer cancel()
+		}
+
+		retryable := p.retry.allows(r.Method)
+		var body []byte
+		if retryable {
+			var err error
+			if body, r, retryable, err = bufferBody(r); err != nil {
+				log.Printf("error reading request body: %v", err)
+				p.errorHandler(w, r, &ProxyError{StatusCode: http.StatusBadRequest, Reason: ReasonRequest, Err: err})
+				return
+			}
+			p.retry.request()
+		}
+
+		var tried []*Upstream
+		for attempt := 1; ; attempt++ {
+			lease, err := p.service.pick(r, tried...)
+			if err != nil {
+				log.Printf("error picking upstream: %v", err)
+				p.errorHandler(w, r, &ProxyError{StatusCode: http.StatusServiceUnavailable, Reason: ReasonNoUpstream, Err: err})
+				return
+			}
+			tried = append(tried, lease.upstream)
+
+			resp, err := p.roundTrip(ctx, r, lease.upstream, body)
+			if err != nil && clientAborted(r) {
+				lease.release(outcomeNone)
+				log.Printf("client aborted request: %s %s", r.Method, r.URL.String())
+				return
+			}
+			if !retryable || !p.retry.shouldRetry(attempt, resp, err) || !p.retry.withdraw() {
+				p.serveResponse(w, r, lease, resp, err)
+				return
+			}
+
+			lease.release(outcomeOf(resp, err))
+			if resp != nil {
+				io.Copy(io.Discard, io.LimitReader(resp.Body, 4096)) // reuse the connection
+				resp.Body.Close()
+			}
+			delay := p.retry.backoff(attempt)
+			log.Printf("retrying %s %s in %v after attempt %d: %v", r.Method, r.URL.String(), delay, attempt, attemptError(resp, err))
+			if err := sleep(ctx, delay); err != nil {
+				if clientAborted(r) {
+					log.Printf("client aborted request: %s %s", r.Method, r.URL.String())
+					return
+				}
+				p.errorHandler(w, r, newUpstreamError(err))
+				return
+			}
+		}
+	}
+}
+
+// roundTrip sends r to upstream, with body when it was buffered for
+// retries.
+func (p *Proxy) roundTrip(ctx context.Context, r *http.Request, upstream *Upstream, body []byte) (*http.Response, error) {
+	outreq := r.Clone(ctx)
+	if body != nil {
+		outreq.Body = io.NopCloser(bytes.NewReader(body))
+		outreq.ContentLength = int64(len(body))
+	} else if r.ContentLength == 0 {
+		outreq.Body = nil // let the transport retry idempotent requests
+	}
+	outreq.Close = false
+
+	if err := p.updateRequest(outreq, upstream.URL); err != nil {
+		return nil, &ProxyError{StatusCode: http.StatusInternalServerError, Reason: ReasonRequest, Err: err}
+	}
+
+	log.Printf("request: %s %s %s", outreq.Method, outreq.URL.String(), outreq.Proto)
+	if upstream.URL.Scheme == schemeH2C {
+		return p.h2cClient.Do(outreq)
+	}
+	return p.client.Do(outreq)
+}
+
+// outcomeOf returns the outcome of an attempt ending with resp or err.
+func outcomeOf(resp *http.Response, err error) outcome {
+	var proxyErr *ProxyError
+	switch {
+	case errors.As(err, &proxyErr):
+		return outcomeNone // not sent
+	case err != nil || resp.StatusCode >= http.StatusInternalServerError:
+		return outcomeFailure
+	}
+	return outcomeSuccess
+}
+
+func attemptError(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("status %d", resp.StatusCode)
+}
+
+// serveResponse writes the response of the last attempt, or its error.
+func (p *Proxy) serveResponse(w http.ResponseWriter, r *http.Request, lease *lease, resp *http.Response, err error) {
+	defer lease.release(outcomeOf(resp, err))
+	if err != nil {
+		var proxyErr *ProxyError
+		if errors.As(err, &proxyErr) {
+			log.Printf("error updating request, got %v", err)
+		} else {
+			proxyErr = newUpstreamError(err)
+			log.Printf("error requesting server (%s): %v", proxyErr.Reason, err)
+		}
+		p.errorHandler(w, r, proxyErr)
+		return
+	}
+	defer resp.Body.Close()
+
+	// only a 101 carries the upgrade back, other responses advertising one
+	// (e.g. Apache's "Upgrade: h2,h2c") offer what the proxy does not
+	removeHopByHopHeaders(resp.Header, resp.StatusCode == http.StatusSwitchingProtocols)
+	addHeaders(w.Header(), resp.Header)
+	if lease.cookie != nil {
+		http.SetCookie(w, lease.cookie)
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if err := p.switchProtocols(w, r, resp); err != nil {
+			log.Printf("error switching protocols: %v", err)
+			p.errorHandler(w, r, &ProxyError{StatusCode: http.StatusBadGateway, Reason: ReasonUpgrade, Err: err})
+		}
+		return
+	}
+
+	announceTrailers(w.Header(), resp.Trailer)
+
+	w.WriteHeader(resp.StatusCode)
+	if len(resp.Trailer) > 0 {
+		// force chunking, so that net/http does not compute a
+		// Content-Length for short bodies and drops the trailers
+		http.NewResponseController(w).Flush()
+	}
+	if err := copyResponse(w, resp.Body, p.flushIntervalFor(resp)); err != nil {
+		if clientAborted(r) {
+			log.Printf("client aborted response: %s %s", r.Method, r.URL.String())
+			return
+		}
+		log.Printf("error copying response: %v", err)
+		if servedByServer(r) {
+			// the response is truncated, abort the connection so that
+			// neither the client nor a cache take it as complete
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+
+	copyTrailers(w.Header(), resp.Trailer)
+}
+
+// WithFlushInterval sets how often the response body is flushed to the
+// client while it is copied, like httputil.ReverseProxy.FlushInterval. Zero
+// disables periodic flushing and a negative value flushes after each write.
+// Event streams and responses of unknown length are always flushed
+// immediately.
+func WithFlushInterval(interval time.Duration) ProxyOptions {
+	return func(p *Proxy) {
+		p.flushInterval = interval
+	}
+}
+
+// servedByServer reports whether r is served by an http.Server or an
+// http3.Server, both aborting the response on a http.ErrAbortHandler panic.
+func servedByServer(r *http.Request) bool {
+	return r.Context().Value(http.ServerContextKey) != nil || r.Context().Value(http3.ServerContextKey) != nil
+}
+
+// clientAborted reports whether the client of r went away.
+func clientAborted(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
+
+func (p *Proxy) flushIntervalFor(resp *http.Response) time.Duration {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" || resp.ContentLength == -1 {
+		return -1
+	}
+	return p.flushInterval
+}
+
+// copyResponse copies body to w and flushes it every interval. Flushing
+// happens on this goroutine, between writes, as http.ResponseWriter is not
+// safe for concurrent use. With a positive interval, body is read on
+// another goroutine, so that a pending flush is not held back by an
+// upstream stalling after a write.
+func copyResponse(w http.ResponseWriter, body io.Reader, interval time.Duration) error {
+	rc := http.NewResponseController(w)
+	flush := func() error {
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	}
+	if interval <= 0 {
+		buf := make([]byte, 32*1024)
+		for {
+			n, readErr := body.Read(buf)
+			if n > 0 {
+				if _, err := w.Write(buf[:n]); err != nil {
+					return err
+				}
+				if interval < 0 {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+			}
+			if readErr == io.EOF {
+				return nil
+			}
+			if readErr != nil {
+				return readErr
+			}
+		}
+	}
+
+	type readResult struct {
+		data []byte
+		err  error
+	}
+	reads := make(chan readResult)
+	written := make(chan struct{}) // the buffer can be read into again
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := body.Read(buf)
+			select {
+			case reads <- readResult{data: buf[:n], err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+			select {
+			case <-written:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	timer := time.NewTimer(interval)
+	timer.Stop()
+	defer timer.Stop()
+	pending := false
+	for {
+		select {
+		case read := <-reads:
+			if len(read.data) > 0 {
+				if _, err := w.Write(read.data); err != nil {
+					return err
+				}
+				if !pending {
+					pending = true
+					timer.Reset(interval)
+				}
+			}
+			if read.err == io.EOF {
+				return nil
+			}
+			if read.err != nil {
+				return read.err
+			}
+			written <- struct{}{}
+		case <-timer.C:
+			pending = false
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *Proxy) updateRequest(r *http.Request, origin *url.URL) error {
+	removeHopByHopHeaders(r.Header, true)
+	if err := p.setForwardedHeaders(r); err != nil {
+		return err
+	}
+
+	r.Host = origin.Host
+	r.URL.Host = origin.Host
+	r.URL.Scheme = upstreamScheme(origin)
+	r.URL.Path, r.URL.RawPath = joinURLPath(origin, r.URL)
+	if origin.RawQuery == "" || r.URL.RawQuery == "" {
+		r.URL.RawQuery = origin.RawQuery + r.URL.RawQuery
+	} else {
+		r.URL.RawQuery = origin.RawQuery + "&" + r.URL.RawQuery
+	}
+	r.RequestURI = ""
+	if r.UserAgent() == "" {
+		r.Header.Set("User-Agent", "")
+	}
+	return nil
+}
+
+// joinURLPath appends the path of u to the base path of origin, with a
+// single slash between them, like httputil.NewSingleHostReverseProxy.
+func joinURLPath(origin, u *url.URL) (path, rawPath string) {
+	if origin.RawPath == "" && u.RawPath == "" {
+		return singleJoiningSlash(origin.Path, u.Path), ""
+	}
+	// the escaped paths are joined as well, to keep encoded slashes
+	originPath, uPath := origin.EscapedPath(), u.EscapedPath()
+	rawPath = singleJoiningSlash(originPath, uPath)
+	path = singleJoiningSlash(origin.Path, u.Path)
+	return path, rawPath
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash, bslash := strings.HasSuffix(a, "/"), strings.HasPrefix(b, "/")
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// hopHeaders are the hop-by-hop headers, meaningful for a single connection
+// only. ref. RFC9110 7.6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers and the ones listed
+// in Connection. "TE: trailers" and, with keepUpgrade, a protocol upgrade are
+// deliberately kept, as the proxy forwards them end to end.
+func removeHopByHopHeaders(h http.Header, keepUpgrade bool) {
+	upgrade := upgradeType(h)
+	trailers := slices.ContainsFunc(h.Values("Te"), func(value string) bool {
+		return headerHasToken(value, "trailers")
+	})
+
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+
+	if keepUpgrade && upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
+
+// upgradeType returns the protocol requested by an Upgrade, if any.
+func upgradeType(h http.Header) string {
+	if !slices.ContainsFunc(h.Values("Connection"), func(value string) bool {
+		return headerHasToken(value, "upgrade")
+	}) {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+// headerHasToken reports whether the comma separated value contains token,
+// case insensitively.
+func headerHasToken(value, token string) bool {
+	return slices.ContainsFunc(strings.Split(value, ","), func(t string) bool {
+		return strings.EqualFold(textproto.TrimString(t), token)
+	})
+}
+
+// announceTrailers declares the trailers of the upstream response in the
+// Trailer header, before the response header is written.
+func announceTrailers(h, trailer http.Header) {
+	for key := range trailer {
+		h.Add("Trailer", key)
+	}
+}
+
+// copyTrailers sets the upstream trailers, once the body is fully read. They
+// use http.TrailerPrefix, so that trailers the upstream did not announce are
+// sent as well.
+func copyTrailers(h, trailer http.Header) {
+	for key, values := range trailer {
+		h[http.TrailerPrefix+key] = values
+	}
+}
+
+// setHeaders replaces the headers of dst present in src, keeping all their
+// values.
+func setHeaders(dst, src http.Header) {
+	for key, values := range src {
+		dst[key] = slices.Clone(values)
+	}
+}
+
+func addHeaders(dst, src http.Header) {
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
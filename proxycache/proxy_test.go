@@ -0,0 +1,600 @@
+package proxycache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy(t *testing.T) {
+	t.Run("check status code, body & headers", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("content-type", "text/plain")
+			w.Header().Set("X-testing-header", "some value")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "some test")
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, req)
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, "text/plain", response.Header().Get("content-type"))
+		assert.Equal(t, "some value", response.Header().Get("X-testing-header"))
+		assert.Equal(t, "some test", response.Body.String())
+	})
+
+	t.Run("forwarded headers", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "hostname:8080", r.Header.Get(HeaderForwardedHost))
+			assert.Equal(t, "http", r.Header.Get(HeaderForwardedProto))
+			assert.Equal(t, "ProxyCache", r.Header.Get(HeaderForwardedServer))
+			w.Header().Set(HeaderForwardedPort, r.Header.Get(HeaderForwardedPort))
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		response := httptest.NewRecorder()
+
+		req.Host = "hostname:8080"
+		proxy.ServeHTTP(response, req)
+		assert.Equal(t, "8080", response.Header().Get(HeaderForwardedPort))
+	})
+
+	t.Run("Remote addr in headers", func(t *testing.T) {
+		var headers []string
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			headers = append(headers, r.Header.Get("X-Forwarded-For"))
+			headers = append(headers, r.Header.Get("X-Real-Ip"))
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "body content")
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		req.RemoteAddr = "10.0.0.1:45"
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, req)
+
+		assert.Equal(t, 2, len(headers))
+		assert.Equal(t, "10.0.0.1", headers[0])
+		assert.Equal(t, "10.0.0.1", headers[1])
+	})
+
+	t.Run("stream support", func(t *testing.T) {
+		// t.Skip("some workarounds")
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("content-type", "text/event-stream")
+			w.Header().Set("Connection", "keep-alive")
+			flusher, ok := w.(http.Flusher)
+			if !ok {
+				http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "some content\n")
+			flusher.Flush()
+			time.Sleep(5 * time.Millisecond) // Not really great for test...
+			fmt.Fprintf(w, "more content\n")
+			flusher.Flush()
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, req)
+
+		assert.True(t, response.Flushed)
+		assert.Equal(t, []string{"some content", "more content"}, strings.Split(strings.Trim(response.Body.String(), "\n"), "\n"))
+	})
+
+	t.Run("known length response is not flushed", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "12")
+			fmt.Fprint(w, "some content")
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, server.URL, nil))
+
+		assert.False(t, response.Flushed)
+		assert.Equal(t, "some content", response.Body.String())
+	})
+
+	t.Run("negative flush interval flushes every write", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "12")
+			fmt.Fprint(w, "some content")
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL, WithFlushInterval(-1))
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, server.URL, nil))
+
+		assert.True(t, response.Flushed)
+	})
+
+	t.Run("writer without Flusher", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("content-type", "text/event-stream")
+			fmt.Fprint(w, "event")
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		response := httptest.NewRecorder()
+
+		assert.NotPanics(t, func() {
+			proxy.ServeHTTP(struct{ http.ResponseWriter }{response}, httptest.NewRequest(http.MethodGet, server.URL, nil))
+		})
+		assert.Equal(t, "event", response.Body.String())
+	})
+
+	t.Run("bad remote addr", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("request forwarded despite the error")
+			w.WriteHeader(http.StatusOK)
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		resp := httptest.NewRecorder()
+
+		req.RemoteAddr = "1.2.3.4"
+		proxy.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusInternalServerError, resp.Result().StatusCode)
+	})
+
+	t.Run("trailer", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Trailer,X-random")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "body content")
+			w.Header().Set("X-Trailer", "Value")
+			w.Header().Set("X-random", "more things")
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, req)
+
+		result := response.Result()
+		assert.ElementsMatch(t, []string{"X-Trailer", "X-Random"}, result.Header.Values("Trailer"))
+		assert.Equal(t, "Value", result.Trailer.Get("X-Trailer"))
+		assert.Equal(t, "more things", result.Trailer.Get("X-random"))
+		assert.Empty(t, result.Header.Get("X-Trailer"))
+	})
+
+	t.Run("undeclared trailer", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "body content")
+			w.(http.Flusher).Flush() // chunked, so that trailers can be sent
+			w.Header().Set(http.TrailerPrefix+"X-Late", "late value")
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, server.URL, nil))
+
+		assert.Equal(t, "late value", response.Result().Trailer.Get("X-Late"))
+	})
+
+	t.Run("no trailer by default", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, req)
+
+		result := response.Result()
+		assert.Empty(t, result.Header.Values("Trailer"))
+		assert.Empty(t, result.Trailer)
+	})
+
+	t.Run("User-Agent", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "tester", r.Header.Get("User-Agent"))
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		response := httptest.NewRecorder()
+		req.Header.Set("user-agent", "tester")
+
+		proxy.ServeHTTP(response, req)
+	})
+
+	t.Run("No User-Agent, no forwarding", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "", r.Header.Get("User-Agent"))
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, req)
+	})
+
+	t.Run("testing middleware", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "some random content")
+		})
+		defer server.Close()
+		middleware := func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+				next.ServeHTTP(w, r)
+			})
+		}
+		proxy := newTestProxy(t, server.URL, WithMiddlewares(middleware))
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, server.URL, nil))
+
+		assert.Equal(t, http.StatusNotFound, response.Code)
+		assert.Equal(t, "some random content", response.Body.String())
+	})
+
+	t.Run("redirects are not followed", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/target" {
+				t.Error("redirect followed by the proxy")
+			}
+			http.Redirect(w, r, "/target", http.StatusFound)
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, server.URL+"/source", nil))
+
+		assert.Equal(t, http.StatusFound, response.Code)
+		assert.Equal(t, "/target", response.Header().Get("Location"))
+	})
+
+	t.Run("transport options", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(50 * time.Millisecond)
+		})
+		defer server.Close()
+		options := DefaultTransportOptions()
+		options.ResponseHeaderTimeout = 10 * time.Millisecond
+		proxy := newTestProxy(t, server.URL, WithTransportOptions(options))
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, server.URL, nil))
+
+		assert.Equal(t, http.StatusGatewayTimeout, response.Code)
+	})
+
+	t.Run("custom transport", func(t *testing.T) {
+		var called bool
+		transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			called = true
+			return &http.Response{StatusCode: http.StatusTeapot, Header: http.Header{}, Body: http.NoBody}, nil
+		})
+		proxy := newTestProxy(t, "http://origin.test", WithTransport(transport))
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		assert.True(t, called)
+		assert.Equal(t, http.StatusTeapot, response.Code)
+	})
+
+	t.Run("hop-by-hop request headers are removed", func(t *testing.T) {
+		var headers http.Header
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			headers = r.Header.Clone()
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		req.Header.Set("Connection", "X-Custom, keep-alive")
+		req.Header.Set("X-Custom", "per connection")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		req.Header.Set("Proxy-Authorization", "Basic secret")
+		req.Header.Set("Te", "gzip")
+		req.Header.Set("X-End-To-End", "kept")
+
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+		for _, name := range []string{"Connection", "X-Custom", "Keep-Alive", "Proxy-Authorization", "Te"} {
+			assert.Empty(t, headers.Values(name), name)
+		}
+		assert.Equal(t, "kept", headers.Get("X-End-To-End"))
+	})
+
+	t.Run("TE: trailers is forwarded", func(t *testing.T) {
+		var te string
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			te = r.Header.Get("Te")
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		req.Header.Set("Te", "trailers, deflate")
+
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.Equal(t, "trailers", te)
+	})
+
+	t.Run("Upgrade is forwarded", func(t *testing.T) {
+		var headers http.Header
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			headers = r.Header.Clone()
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		req.Header.Set("Connection", "keep-alive, Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.Equal(t, "Upgrade", headers.Get("Connection"))
+		assert.Equal(t, "websocket", headers.Get("Upgrade"))
+	})
+
+	t.Run("hop-by-hop response headers are removed", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Connection", "X-Custom")
+			w.Header().Set("X-Custom", "per connection")
+			w.Header().Set("Keep-Alive", "timeout=5")
+			w.Header().Set("Proxy-Authenticate", "Basic")
+			w.Header().Set("X-End-To-End", "kept")
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, server.URL, nil))
+
+		for _, name := range []string{"Connection", "X-Custom", "Keep-Alive", "Proxy-Authenticate"} {
+			assert.Empty(t, response.Header().Values(name), name)
+		}
+		assert.Equal(t, "kept", response.Header().Get("X-End-To-End"))
+	})
+
+	t.Run("Upgrade is removed from other responses than 101", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Connection", "Upgrade")
+			w.Header().Set("Upgrade", "h2,h2c")
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, server.URL, nil))
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Empty(t, response.Header().Values("Connection"))
+		assert.Empty(t, response.Header().Values("Upgrade"))
+	})
+
+	t.Run("client cancellation is propagated upstream", func(t *testing.T) {
+		cancelled := make(chan bool, 1)
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+				cancelled <- true
+			case <-time.After(time.Second):
+				cancelled <- false
+			}
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		time.AfterFunc(20*time.Millisecond, cancel)
+
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.True(t, <-cancelled)
+	})
+
+	t.Run("upstream timeout", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL, WithUpstreamTimeout(20*time.Millisecond))
+		response := httptest.NewRecorder()
+		start := time.Now()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, server.URL, nil))
+
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+		assert.Equal(t, http.StatusGatewayTimeout, response.Code)
+	})
+
+	t.Run("incoming request is not modified", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL)
+		req := httptest.NewRequest(http.MethodGet, "/path", nil)
+		req.Host = "example.com"
+
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.Equal(t, "example.com", req.Host)
+		assert.Equal(t, "/path", req.URL.String())
+		assert.Empty(t, req.Header.Get(HeaderForwardedFor))
+	})
+
+	t.Run("Basic Authentication", func(t *testing.T) {
+		t.Skip("TODO")
+	})
+	t.Run("OAuth Authentication", func(t *testing.T) {
+		t.Skip("TODO")
+	})
+}
+
+func newTestProxy(t *testing.T, origin string, options ...ProxyOptions) *Proxy {
+	t.Helper()
+	proxy, err := NewProxy(origin, options...)
+	require.NoError(t, err)
+	return proxy
+}
+
+func createTestServer(f http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(f)
+}
+
+func TestNewProxy(t *testing.T) {
+	tests := []struct {
+		desc    string
+		origin  string
+		options []ProxyOptions
+		wantErr string
+	}{
+		{desc: "valid origin", origin: "http://localhost:8000"},
+		{desc: "https origin with path", origin: "https://backend.example.com/api"},
+		{desc: "h2c origin", origin: "h2c://localhost:8000"},
+		{
+			desc:    "h2c origin with a custom round tripper",
+			origin:  "h2c://localhost:8000",
+			options: []ProxyOptions{WithTransport(roundTripperFunc(nil))},
+			wantErr: "h2c upstreams need an *http.Transport",
+		},
+		{desc: "missing scheme", origin: "localhost:8000", wantErr: "scheme must be http, https, h2c, tcp or udp"},
+		{desc: "unsupported scheme", origin: "ftp://localhost", wantErr: "scheme must be http, https, h2c, tcp or udp"},
+		{desc: "tcp origin", origin: "tcp://localhost:5432", wantErr: "scheme must be http, https, h2c"},
+		{desc: "missing host", origin: "http://", wantErr: "missing host"},
+		{desc: "unparsable origin", origin: "http://local host", wantErr: "invalid origin"},
+		{desc: "empty origin", origin: "", wantErr: "invalid origin"},
+		{
+			desc:    "negative upstream timeout",
+			origin:  "http://localhost:8000",
+			options: []ProxyOptions{WithUpstreamTimeout(-time.Second)},
+			wantErr: "invalid upstream timeout",
+		},
+		{
+			desc:    "nil error handler",
+			origin:  "http://localhost:8000",
+			options: []ProxyOptions{WithErrorHandler(nil)},
+			wantErr: "invalid error handler",
+		},
+		{
+			desc:    "invalid trusted proxy",
+			origin:  "http://localhost:8000",
+			options: []ProxyOptions{WithTrustedProxies(netip.Prefix{})},
+			wantErr: "invalid trusted proxy",
+		},
+		{
+			desc:    "nil middleware",
+			origin:  "http://localhost:8000",
+			options: []ProxyOptions{WithMiddlewares(nil)},
+			wantErr: "invalid middleware",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			proxy, err := NewProxy(tt.origin, tt.options...)
+
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				assert.Nil(t, proxy)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NotNil(t, proxy)
+		})
+	}
+}
+
+func TestCopyResponse(t *testing.T) {
+	body, writer := io.Pipe()
+	go func() {
+		for range 4 {
+			writer.Write([]byte("chunk"))
+			time.Sleep(20 * time.Millisecond)
+		}
+		writer.Close()
+	}()
+	response := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+
+	err := copyResponse(response, body, 30*time.Millisecond)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "chunkchunkchunkchunk", response.Body.String())
+	assert.GreaterOrEqual(t, response.flushes, 1)
+	assert.Less(t, response.flushes, 4)
+}
+
+func TestCopyResponseStalledUpstream(t *testing.T) {
+	body, writer := io.Pipe()
+	defer writer.Close()
+	response := &flushNotifier{ResponseRecorder: httptest.NewRecorder(), flushed: make(chan struct{}, 1)}
+	copied := make(chan error, 1)
+	go func() { copied <- copyResponse(response, body, 20*time.Millisecond) }()
+
+	writer.Write([]byte("chunk")) // then stalls
+
+	select {
+	case <-response.flushed:
+	case <-time.After(time.Second):
+		t.Fatal("pending flush held back by the stalled upstream")
+	}
+	writer.Close()
+	assert.NoError(t, <-copied)
+	assert.Equal(t, "chunk", response.Body.String())
+}
+
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (f *flushCounter) Flush() {
+	f.flushes++
+	f.ResponseRecorder.Flush()
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// flushNotifier signals each flush.
+type flushNotifier struct {
+	*httptest.ResponseRecorder
+	flushed chan struct{}
+}
+
+func (f *flushNotifier) Flush() {
+	f.ResponseRecorder.Flush()
+	select {
+	case f.flushed <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,158 @@
+package proxycache
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+)
+
+// HeaderPurgeToken carries the shared secret of PURGE and BAN requests.
+const HeaderPurgeToken = "X-Purge-Token"
+
+// HeaderBanURL carries the URL regular expression of BAN requests.
+const HeaderBanURL = "X-Ban-Url"
+
+type purgeOptions struct {
+	purgeMethod string
+	banMethod   string
+	networks    []netip.Prefix
+	secret      string
+}
+
+// WithPurgeMethod enables cache invalidation for the requested URL with the
+// given method, e.g. "PURGE".
+func WithPurgeMethod(method string) CacheOptions {
+	return func(o *cacheOptions) {
+		o.purge.purgeMethod = method
+	}
+}
+
+// WithBanMethod enables cache invalidation of every URL matching the regular
+// expression in the X-Ban-Url header with the given method, e.g. "BAN".
+func WithBanMethod(method string) CacheOptions {
+	return func(o *cacheOptions) {
+		o.purge.banMethod = method
+	}
+}
+
+// WithPurgeNetworks allows PURGE and BAN requests from clients in networks.
+func WithPurgeNetworks(networks ...netip.Prefix) CacheOptions {
+	return func(o *cacheOptions) {
+		o.purge.networks = append(o.purge.networks, networks...)
+	}
+}
+
+// WithPurgeSecret allows PURGE and BAN requests carrying secret in the
+// X-Purge-Token header.
+func WithPurgeSecret(secret string) CacheOptions {
+	return func(o *cacheOptions) {
+		o.purge.secret = secret
+	}
+}
+
+// handlePurge answers PURGE and BAN requests. It returns false when r is
+// not one of them and should go through the cache as usual.
+func handlePurge(w http.ResponseWriter, r *http.Request, cache Cache, opts *purgeOptions) bool {
+	isPurge := opts.purgeMethod != "" && r.Method == opts.purgeMethod
+	isBan := opts.banMethod != "" && r.Method == opts.banMethod
+	if !isPurge && !isBan {
+		return false
+	}
+
+	if !opts.allowed(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "purge not allowed"})
+		return true
+	}
+	purgeable, ok := cache.(PurgeableCache)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "cache does not support purging"})
+		return true
+	}
+
+	var purged int
+	var err error
+	if isPurge {
+		purged, err = purgeURL(purgeable, r)
+	} else {
+		pattern, compileErr := regexp.Compile(r.Header.Get(HeaderBanURL))
+		if r.Header.Get(HeaderBanURL) == "" || compileErr != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid or missing " + HeaderBanURL})
+			return true
+		}
+		purged, err = purgeMatching(purgeable, func(entity *CacheEntity) bool {
+			return pattern.MatchString(entity.URL)
+		})
+	}
+	if err != nil {
+		writeError(w, err)
+		return true
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+	return true
+}
+
+func (o *purgeOptions) allowed(r *http.Request) bool {
+	if o.secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(HeaderPurgeToken)), []byte(o.secret)) == 1 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(o.networks, func(network netip.Prefix) bool {
+		return network.Contains(addr.Unmap())
+	})
+}
+
+// purgeURL deletes the cached GET and HEAD responses of the requested URL.
+func purgeURL(cache PurgeableCache, r *http.Request) (int, error) {
+	var purged int
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		variant := new(http.Request)
+		*variant = *r
+		variant.Method = method
+		key := getETag(variant)
+		entity, err := cache.Get(key)
+		if err != nil {
+			return purged, err
+		}
+		if entity == nil {
+			continue
+		}
+		if err := cache.Delete(key); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// purgeMatching deletes the entries of cache for which match returns true.
+func purgeMatching(cache PurgeableCache, match func(*CacheEntity) bool) (int, error) {
+	keys, err := cache.Keys()
+	if err != nil {
+		return 0, err
+	}
+	var purged int
+	for _, key := range keys {
+		entity, err := cache.Get(key)
+		if err != nil {
+			return purged, err
+		}
+		if entity == nil || !match(entity) {
+			continue
+		}
+		if err := cache.Delete(key); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
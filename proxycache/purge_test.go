@@ -0,0 +1,134 @@
+package proxycache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurge(t *testing.T) {
+	setup := func(t *testing.T, options ...CacheOptions) (*Proxy, *InMemoryCache, string) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "content of %s", r.URL.Path)
+		})
+		t.Cleanup(server.Close)
+		cache := NewInMemoryCache(10)
+		options = append([]CacheOptions{WithPurgeMethod("PURGE"), WithBanMethod("BAN")}, options...)
+		proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(cache, options...)))
+		for _, path := range []string{"/products/1", "/products/2", "/home"} {
+			proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, server.URL+path, nil))
+			proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodHead, server.URL+path, nil))
+		}
+		keys, _ := cache.Keys()
+		require.Len(t, keys, 6)
+		return proxy, cache, server.URL
+	}
+	allowLocal := WithPurgeNetworks(netip.MustParsePrefix("10.0.0.0/8"))
+
+	t.Run("PURGE removes GET and HEAD entries of the URL", func(t *testing.T) {
+		proxy, cache, origin := setup(t, allowLocal)
+		request := httptest.NewRequest("PURGE", origin+"/products/1", nil)
+		request.RemoteAddr = "10.1.2.3:1234"
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, request)
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, `{"purged": 2}`, response.Body.String())
+		keys, _ := cache.Keys()
+		assert.Len(t, keys, 4)
+		response = httptest.NewRecorder()
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, origin+"/products/1", nil))
+		assert.Equal(t, "MISS", response.Header().Get("X-Cache-Status"))
+	})
+
+	t.Run("BAN removes entries matching the regexp", func(t *testing.T) {
+		proxy, cache, origin := setup(t, allowLocal)
+		request := httptest.NewRequest("BAN", origin+"/", nil)
+		request.RemoteAddr = "10.1.2.3:1234"
+		request.Header.Set(HeaderBanURL, `/products/\d+$`)
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, request)
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, `{"purged": 4}`, response.Body.String())
+		keys, _ := cache.Keys()
+		assert.Len(t, keys, 2)
+	})
+
+	t.Run("BAN needs a valid regexp", func(t *testing.T) {
+		proxy, _, origin := setup(t, allowLocal)
+		for _, pattern := range []string{"", "("} {
+			request := httptest.NewRequest("BAN", origin+"/", nil)
+			request.RemoteAddr = "10.1.2.3:1234"
+			request.Header.Set(HeaderBanURL, pattern)
+			response := httptest.NewRecorder()
+
+			proxy.ServeHTTP(response, request)
+
+			assert.Equal(t, http.StatusBadRequest, response.Code, pattern)
+		}
+	})
+
+	t.Run("forbidden outside of the allowed networks", func(t *testing.T) {
+		proxy, cache, origin := setup(t, allowLocal)
+		request := httptest.NewRequest("PURGE", origin+"/products/1", nil)
+		request.RemoteAddr = "192.168.1.1:1234"
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, request)
+
+		assert.Equal(t, http.StatusForbidden, response.Code)
+		keys, _ := cache.Keys()
+		assert.Len(t, keys, 6)
+	})
+
+	t.Run("allowed with the shared secret", func(t *testing.T) {
+		proxy, _, origin := setup(t, WithPurgeSecret("secret"))
+		request := httptest.NewRequest("PURGE", origin+"/home", nil)
+		request.RemoteAddr = "192.168.1.1:1234"
+		request.Header.Set(HeaderPurgeToken, "secret")
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, request)
+
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		request.Header.Set(HeaderPurgeToken, "wrong")
+		response = httptest.NewRecorder()
+		proxy.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusForbidden, response.Code)
+	})
+
+	t.Run("cache without purge support", func(t *testing.T) {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(newStubCache(nil, nil, nil), WithPurgeMethod("PURGE"), WithPurgeSecret("secret"))))
+		request := httptest.NewRequest("PURGE", server.URL, nil)
+		request.Header.Set(HeaderPurgeToken, "secret")
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, request)
+
+		assert.Equal(t, http.StatusNotImplemented, response.Code)
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		var method string
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			method = r.Method
+		})
+		defer server.Close()
+		proxy := newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(NewInMemoryCache(10))))
+
+		proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PURGE", server.URL, nil))
+
+		assert.Equal(t, "PURGE", method)
+	})
+}
@@ -0,0 +1,207 @@
+package proxycache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxRetryBody is the largest request body kept in memory to be sent again
+// on retry. Requests with a larger body are not retried.
+const maxRetryBody = 1 << 20
+
+// RetryPolicy retries the requests failing with a transport error or one of
+// Statuses, on another upstream when the service has one. The attempts are
+// spaced with an exponential backoff with jitter, and retries are limited
+// by a budget so that they do not overload a struggling service. Zero
+// values get the defaults of DefaultRetryPolicy.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts, the first one included.
+	Attempts int
+	Statuses []int
+	// Methods are the methods retried. Only add non-idempotent ones, such
+	// as POST, when the upstream can handle duplicates.
+	Methods        []string
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Budget is the ratio of retries to requests allowed within
+	// BudgetWindow, on top of MinRetries retries.
+	Budget       float64
+	MinRetries   int
+	BudgetWindow time.Duration
+}
+
+// DefaultRetryPolicy returns the policy used for the zero fields.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:       3,
+		Statuses:       []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+		Methods:        []string{http.MethodGet, http.MethodHead},
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Budget:         0.2,
+		MinRetries:     3,
+		BudgetWindow:   10 * time.Second,
+	}
+}
+
+// WithRetry retries the failed requests, see RetryPolicy.
+func WithRetry(policy RetryPolicy) ProxyOptions {
+	return func(p *Proxy) {
+		defaults := DefaultRetryPolicy()
+		if policy.Attempts == 0 {
+			policy.Attempts = defaults.Attempts
+		}
+		if policy.Statuses == nil {
+			policy.Statuses = defaults.Statuses
+		}
+		if policy.Methods == nil {
+			policy.Methods = defaults.Methods
+		}
+		if policy.InitialBackoff == 0 {
+			policy.InitialBackoff = defaults.InitialBackoff
+		}
+		if policy.MaxBackoff == 0 {
+			policy.MaxBackoff = max(defaults.MaxBackoff, policy.InitialBackoff)
+		}
+		if policy.Budget == 0 {
+			policy.Budget = defaults.Budget
+		}
+		if policy.MinRetries == 0 {
+			policy.MinRetries = defaults.MinRetries
+		}
+		if policy.BudgetWindow == 0 {
+			policy.BudgetWindow = defaults.BudgetWindow
+		}
+		p.retry = &retrier{policy: policy}
+	}
+}
+
+func (policy *RetryPolicy) validate() error {
+	if policy.Attempts < 1 {
+		return fmt.Errorf("invalid retry attempts %d: must be at least 1", policy.Attempts)
+	}
+	if policy.InitialBackoff < 0 || policy.MaxBackoff < policy.InitialBackoff {
+		return errors.New("invalid retry backoff: negative, or max backoff below initial backoff")
+	}
+	if policy.Budget < 0 || policy.MinRetries < 0 || policy.BudgetWindow < 0 {
+		return errors.New("invalid retry budget: negative")
+	}
+	return nil
+}
+
+// retrier applies a RetryPolicy and keeps its budget.
+type retrier struct {
+	policy RetryPolicy
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+// allows reports whether the requests of method may be retried.
+func (rt *retrier) allows(method string) bool {
+	return rt != nil && slices.Contains(rt.policy.Methods, method)
+}
+
+// shouldRetry reports whether an attempt ending with resp or err is
+// retried, err being the transport error.
+func (rt *retrier) shouldRetry(attempt int, resp *http.Response, err error) bool {
+	if attempt >= rt.policy.Attempts {
+		return false
+	}
+	if err != nil {
+		var proxyErr *ProxyError
+		// the deadline covers all the attempts, and a request which could
+		// not be forwarded will not be forwarded either on retry
+		return !errors.As(err, &proxyErr) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	return slices.Contains(rt.policy.Statuses, resp.StatusCode)
+}
+
+// request counts a request in the budget.
+func (rt *retrier) request() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.refresh()
+	rt.requests++
+}
+
+// withdraw takes a retry from the budget, if any is left.
+func (rt *retrier) withdraw() bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.refresh()
+	if rt.retries >= rt.policy.MinRetries+int(rt.policy.Budget*float64(rt.requests)) {
+		return false
+	}
+	rt.retries++
+	return true
+}
+
+func (rt *retrier) refresh() {
+	if now := time.Now(); now.Sub(rt.windowStart) >= rt.policy.BudgetWindow {
+		rt.windowStart, rt.requests, rt.retries = now, 0, 0
+	}
+}
+
+// backoff returns the wait before the attempt following attempt: half of
+// the exponential backoff plus a random part of the other half.
+func (rt *retrier) backoff(attempt int) time.Duration {
+	d := rt.policy.InitialBackoff
+	for i := 1; i < attempt && d < rt.policy.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, rt.policy.MaxBackoff)
+	if d < 2 {
+		return d
+	}
+	return d/2 + rand.N(d/2)
+}
+
+// sleep waits for d, or returns the error of ctx when it is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// bufferBody reads the body of r in memory, so that it can be sent again.
+// When it is too large, ok is false and the returned request streams it
+// once.
+func bufferBody(r *http.Request) (body []byte, r2 *http.Request, ok bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil, r, true, nil
+	}
+	if r.ContentLength > maxRetryBody {
+		return nil, r, false, nil
+	}
+	body, err = io.ReadAll(io.LimitReader(r.Body, maxRetryBody+1))
+	if err != nil {
+		return nil, r, false, err
+	}
+	r2 = new(http.Request)
+	*r2 = *r
+	if len(body) > maxRetryBody {
+		r2.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, r2, false, nil
+	}
+	r2.Body = http.NoBody
+	return body, r2, true, nil
+}
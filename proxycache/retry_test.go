@@ -0,0 +1,160 @@
+package proxycache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRetryProxy returns a round-robin proxy to the handlers, counting their
+// requests.
+func newRetryProxy(t *testing.T, policy RetryPolicy, handlers ...http.HandlerFunc) (*Proxy, []*atomic.Int32) {
+	t.Helper()
+	var upstreams []*Upstream
+	var hits []*atomic.Int32
+	for _, handler := range handlers {
+		count := new(atomic.Int32)
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			count.Add(1)
+			handler(w, r)
+		})
+		t.Cleanup(server.Close)
+		upstream, err := NewUpstream(server.URL, 1)
+		require.NoError(t, err)
+		upstreams = append(upstreams, upstream)
+		hits = append(hits, count)
+	}
+	service, err := NewService(upstreams)
+	require.NoError(t, err)
+	proxy, err := NewServiceProxy(service, WithRetry(policy))
+	require.NoError(t, err)
+	return proxy, hits
+}
+
+func status(code int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(code)
+		w.Write(body)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	fast := RetryPolicy{InitialBackoff: time.Millisecond}
+
+	t.Run("on another upstream", func(t *testing.T) {
+		proxy, hits := newRetryProxy(t, fast, status(http.StatusBadGateway), status(http.StatusOK))
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.EqualValues(t, 1, hits[0].Load())
+		assert.EqualValues(t, 1, hits[1].Load())
+	})
+
+	t.Run("connection error", func(t *testing.T) {
+		proxy, hits := newRetryProxy(t, fast, status(http.StatusOK), status(http.StatusOK))
+		proxy.service.upstreams[0].URL.Host = "127.0.0.1:1" // nothing listens there
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.EqualValues(t, 1, hits[1].Load())
+	})
+
+	t.Run("attempts exhausted", func(t *testing.T) {
+		proxy, hits := newRetryProxy(t, RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond}, status(http.StatusServiceUnavailable), status(http.StatusServiceUnavailable))
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+		assert.EqualValues(t, 3, hits[0].Load()+hits[1].Load())
+	})
+
+	t.Run("status not retried", func(t *testing.T) {
+		proxy, hits := newRetryProxy(t, fast, status(http.StatusInternalServerError), status(http.StatusOK))
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		assert.Equal(t, http.StatusInternalServerError, response.Code)
+		assert.EqualValues(t, 0, hits[1].Load())
+	})
+
+	t.Run("non-idempotent method not retried", func(t *testing.T) {
+		proxy, hits := newRetryProxy(t, fast, status(http.StatusBadGateway), status(http.StatusOK))
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("order")))
+
+		assert.Equal(t, http.StatusBadGateway, response.Code)
+		assert.EqualValues(t, 0, hits[1].Load())
+	})
+
+	t.Run("allowed method with body", func(t *testing.T) {
+		policy := RetryPolicy{Methods: []string{http.MethodPost}, InitialBackoff: time.Millisecond}
+		proxy, _ := newRetryProxy(t, policy, status(http.StatusBadGateway), status(http.StatusOK))
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("order")))
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, "order", response.Body.String())
+	})
+
+	t.Run("body too large", func(t *testing.T) {
+		policy := RetryPolicy{Methods: []string{http.MethodPut}, InitialBackoff: time.Millisecond}
+		proxy, hits := newRetryProxy(t, policy, status(http.StatusBadGateway), status(http.StatusOK))
+		body := strings.Repeat("a", maxRetryBody+1)
+		request := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+		request.ContentLength = -1
+		response := httptest.NewRecorder()
+
+		proxy.ServeHTTP(response, request)
+
+		assert.Equal(t, http.StatusBadGateway, response.Code)
+		assert.Equal(t, len(body), response.Body.Len(), "streamed once")
+		assert.EqualValues(t, 0, hits[1].Load())
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		policy := RetryPolicy{Budget: 0.01, MinRetries: 1, InitialBackoff: time.Millisecond}
+		proxy, hits := newRetryProxy(t, policy, status(http.StatusBadGateway), status(http.StatusBadGateway))
+
+		for range 3 {
+			proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+
+		assert.EqualValues(t, 4, hits[0].Load()+hits[1].Load(), "a single retry")
+	})
+}
+
+func TestRetryBackoff(t *testing.T) {
+	rt := &retrier{policy: RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}}
+
+	for attempt, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 300 * time.Millisecond, 40: 300 * time.Millisecond} {
+		for range 10 {
+			d := rt.backoff(attempt)
+			assert.GreaterOrEqual(t, d, want/2)
+			assert.Less(t, d, want)
+		}
+	}
+}
+
+func TestWithRetryValidation(t *testing.T) {
+	_, err := NewProxy("http://backend", WithRetry(RetryPolicy{Attempts: -1}))
+	assert.Error(t, err)
+
+	_, err = NewProxy("http://backend", WithRetry(RetryPolicy{InitialBackoff: time.Second, MaxBackoff: time.Millisecond}))
+	assert.Error(t, err)
+}
@@ -0,0 +1,126 @@
+package proxycache
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// HeaderForwardedPrefix carries the path prefix removed by StripPrefix.
+const HeaderForwardedPrefix = "X-Forwarded-Prefix"
+
+// strippedPrefixesKey is the context key of the prefixes removed by
+// StripPrefix, set again once the X-Forwarded-Prefix of untrusted clients
+// is dropped.
+type strippedPrefixesKey struct{}
+
+// StripPrefix removes the first matching prefix from the request path.
+// Requests matching none of the prefixes are left untouched.
+func StripPrefix(prefixes ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, prefix := range prefixes {
+				path, ok := strings.CutPrefix(r.URL.Path, prefix)
+				if !ok {
+					continue
+				}
+				r = withURL(r, func(u *url.URL) {
+					u.Path = ensureLeadingSlash(path)
+					if rawPath, ok := strings.CutPrefix(u.RawPath, prefix); ok {
+						u.RawPath = ensureLeadingSlash(rawPath)
+					} else {
+						u.RawPath = ""
+					}
+				})
+				r.Header.Add(HeaderForwardedPrefix, prefix)
+				prefixes, _ := r.Context().Value(strippedPrefixesKey{}).([]string)
+				r = r.WithContext(context.WithValue(r.Context(), strippedPrefixesKey{}, append(slices.Clip(prefixes), prefix)))
+				break
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// AddPrefix prepends prefix to the request path.
+func AddPrefix(prefix string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = withURL(r, func(u *url.URL) {
+				u.Path = singleJoiningSlash(prefix, u.Path)
+				if u.RawPath != "" {
+					u.RawPath = singleJoiningSlash(prefix, u.RawPath)
+				}
+			})
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ReplacePathRegex rewrites the request path matching pattern with
+// replacement, which can refer to the submatches as $1 or ${name}.
+func ReplacePathRegex(pattern *regexp.Regexp, replacement string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if pattern.MatchString(r.URL.Path) {
+				r = withURL(r, func(u *url.URL) {
+					u.Path = ensureLeadingSlash(pattern.ReplaceAllString(u.Path, replacement))
+					u.RawPath = ""
+				})
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// QueryRules lists the changes made to the query string by RewriteQuery,
+// applied in the order Delete, Set then Add.
+type QueryRules struct {
+	Delete []string
+	Set    map[string]string
+	Add    map[string]string
+}
+
+// RewriteQuery modifies the query string of the request.
+func RewriteQuery(rules QueryRules) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = withURL(r, func(u *url.URL) {
+				query := u.Query()
+				for _, key := range rules.Delete {
+					query.Del(key)
+				}
+				for key, value := range rules.Set {
+					query.Set(key, value)
+				}
+				for key, value := range rules.Add {
+					query.Add(key, value)
+				}
+				u.RawQuery = query.Encode()
+			})
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// withURL returns a shallow copy of r with its URL modified by f, leaving r
+// untouched for the previous handlers. The headers are copied as well.
+func withURL(r *http.Request, f func(*url.URL)) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.Header = r.Header.Clone()
+	f(r2.URL)
+	return r2
+}
+
+func ensureLeadingSlash(path string) string {
+	if path == "" || path[0] != '/' {
+		return "/" + path
+	}
+	return path
+}
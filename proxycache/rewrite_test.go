@@ -0,0 +1,148 @@
+package proxycache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		desc        string
+		origin      string
+		middlewares []Middleware
+		target      string
+		wantURI     string
+		wantPrefix  string
+	}{
+		{
+			desc:    "origin without path",
+			origin:  "http://backend",
+			target:  "/users?id=1",
+			wantURI: "/users?id=1",
+		},
+		{
+			desc:    "origin base path",
+			origin:  "http://backend/api/v2",
+			target:  "/users",
+			wantURI: "/api/v2/users",
+		},
+		{
+			desc:    "origin base path with trailing slash",
+			origin:  "http://backend/api/v2/",
+			target:  "/users",
+			wantURI: "/api/v2/users",
+		},
+		{
+			desc:    "origin query",
+			origin:  "http://backend/api?key=secret",
+			target:  "/users?id=1",
+			wantURI: "/api/users?key=secret&id=1",
+		},
+		{
+			desc:    "encoded slash is kept",
+			origin:  "http://backend/api",
+			target:  "/files/a%2Fb",
+			wantURI: "/api/files/a%2Fb",
+		},
+		{
+			desc:        "strip prefix",
+			origin:      "http://backend",
+			middlewares: []Middleware{StripPrefix("/other", "/service")},
+			target:      "/service/users",
+			wantURI:     "/users",
+			wantPrefix:  "/service",
+		},
+		{
+			desc:        "strip whole path",
+			origin:      "http://backend",
+			middlewares: []Middleware{StripPrefix("/service")},
+			target:      "/service",
+			wantURI:     "/",
+			wantPrefix:  "/service",
+		},
+		{
+			desc:        "strip prefix not matching",
+			origin:      "http://backend",
+			middlewares: []Middleware{StripPrefix("/service")},
+			target:      "/users",
+			wantURI:     "/users",
+		},
+		{
+			desc:        "strip then add prefix",
+			origin:      "http://backend",
+			middlewares: []Middleware{StripPrefix("/service"), AddPrefix("/v2")},
+			target:      "/service/users",
+			wantURI:     "/v2/users",
+			wantPrefix:  "/service",
+		},
+		{
+			desc:        "replace path regex",
+			origin:      "http://backend",
+			middlewares: []Middleware{ReplacePathRegex(regexp.MustCompile(`^/users/(\d+)$`), "/accounts/$1/profile")},
+			target:      "/users/42?full=true",
+			wantURI:     "/accounts/42/profile?full=true",
+		},
+		{
+			desc:        "rewrite query",
+			origin:      "http://backend",
+			middlewares: []Middleware{RewriteQuery(QueryRules{Delete: []string{"debug"}, Set: map[string]string{"page": "1"}, Add: map[string]string{"tag": "b"}})},
+			target:      "/search?debug=1&page=3&tag=a",
+			wantURI:     "/search?page=1&tag=a&tag=b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var gotURI, gotPrefix string
+			server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+				gotURI = r.RequestURI
+				gotPrefix = r.Header.Get(HeaderForwardedPrefix)
+			})
+			defer server.Close()
+			origin := server.URL + tt.origin[len("http://backend"):]
+			proxy := newTestProxy(t, origin, WithMiddlewares(tt.middlewares...))
+			request := httptest.NewRequest(http.MethodGet, tt.target, nil)
+
+			proxy.ServeHTTP(httptest.NewRecorder(), request)
+
+			assert.Equal(t, tt.wantURI, gotURI)
+			assert.Equal(t, tt.wantPrefix, gotPrefix)
+			assert.Equal(t, tt.target, request.URL.RequestURI(), "incoming request modified")
+		})
+	}
+}
+
+func TestStripPrefixForwardedPrefix(t *testing.T) {
+	tests := []struct {
+		desc       string
+		remoteAddr string
+		want       []string
+	}{
+		{desc: "untrusted client", remoteAddr: "192.0.2.1:1234", want: []string{"/service"}},
+		{desc: "trusted proxy", remoteAddr: "10.0.0.1:1234", want: []string{"/edge", "/service"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var got []string
+			server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Values(HeaderForwardedPrefix)
+			})
+			defer server.Close()
+			proxy := newTestProxy(t, server.URL,
+				WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8")),
+				WithMiddlewares(StripPrefix("/service")),
+			)
+			request := httptest.NewRequest(http.MethodGet, "/service/users", nil)
+			request.RemoteAddr = tt.remoteAddr
+			request.Header.Set(HeaderForwardedPrefix, "/edge")
+
+			proxy.ServeHTTP(httptest.NewRecorder(), request)
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
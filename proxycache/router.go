@@ -0,0 +1,162 @@
+package proxycache
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Route sends the requests matching all of its matchers to Handler,
+// usually a Proxy to a backend service. Empty matchers match everything.
+type Route struct {
+	Name string
+	// Priority orders the routes, the highest first. Routes of equal
+	// priority are ordered by specificity: longest path prefix, then exact
+	// hosts before wildcard ones, then declaration order.
+	Priority int
+	// Hosts are matched against the Host header, without its port. A host
+	// starting with "*." matches any of its subdomains.
+	Hosts      []string
+	PathPrefix string
+	Methods    []string
+	// Headers and Query match exact values, "*" only requires presence.
+	Headers map[string]string
+	Query   map[string]string
+	Handler http.Handler
+}
+
+// Router picks the Route of each request. Requests matching no route get
+// a 404 Not Found.
+type Router struct {
+	routes []*Route
+	scopes map[*Route]string
+}
+
+// routeScopeKey is the context key of the route of a request, part of its
+// cache key: routes rewriting onto the same upstream URL, or sending it to
+// different services, must not share cache entries.
+type routeScopeKey struct{}
+
+// NewRouter returns a Router over routes, which must all have a Handler.
+func NewRouter(routes ...*Route) (*Router, error) {
+	for i, route := range routes {
+		if route == nil || route.Handler == nil {
+			return nil, fmt.Errorf("invalid route %d: missing handler", i)
+		}
+		for _, host := range route.Hosts {
+			if host == "" || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+				return nil, fmt.Errorf("invalid route %q: invalid host %q", route.Name, host)
+			}
+		}
+		if route.PathPrefix != "" && !strings.HasPrefix(route.PathPrefix, "/") {
+			return nil, fmt.Errorf("invalid route %q: path prefix %q must start with /", route.Name, route.PathPrefix)
+		}
+	}
+	if len(routes) == 0 {
+		return nil, errors.New("no route")
+	}
+
+	scopes := map[*Route]string{}
+	for i, route := range routes {
+		scopes[route] = strconv.Itoa(i)
+	}
+	sorted := slices.Clone(routes)
+	slices.SortStableFunc(sorted, func(a, b *Route) int {
+		return cmp.Or(
+			cmp.Compare(b.Priority, a.Priority),
+			cmp.Compare(len(b.PathPrefix), len(a.PathPrefix)),
+			cmp.Compare(hostSpecificity(b.Hosts), hostSpecificity(a.Hosts)),
+		)
+	})
+	return &Router{routes: sorted, scopes: scopes}, nil
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := rt.Match(r)
+	if route == nil {
+		http.NotFound(w, r)
+		return
+	}
+	route.Handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeScopeKey{}, rt.scopes[route])))
+}
+
+// Match returns the route of r, nil when none matches.
+func (rt *Router) Match(r *http.Request) *Route {
+	for _, route := range rt.routes {
+		if route.matches(r) {
+			return route
+		}
+	}
+	return nil
+}
+
+func (route *Route) matches(r *http.Request) bool {
+	if len(route.Hosts) > 0 && !slices.ContainsFunc(route.Hosts, func(host string) bool {
+		return matchHost(host, requestHost(r))
+	}) {
+		return false
+	}
+	if !strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+		return false
+	}
+	if len(route.Methods) > 0 && !slices.ContainsFunc(route.Methods, func(method string) bool {
+		return strings.EqualFold(method, r.Method)
+	}) {
+		return false
+	}
+	for name, value := range route.Headers {
+		if !matchValues(r.Header.Values(name), value) {
+			return false
+		}
+	}
+	query := r.URL.Query()
+	for name, value := range route.Query {
+		if !matchValues(query[name], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestHost returns the Host of r, lowercased and without port.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return pattern == host
+}
+
+func matchValues(values []string, want string) bool {
+	if want == "*" {
+		return len(values) > 0
+	}
+	return slices.Contains(values, want)
+}
+
+// hostSpecificity ranks exact hosts before wildcard ones, before no host.
+func hostSpecificity(hosts []string) int {
+	if len(hosts) == 0 {
+		return 0
+	}
+	for _, host := range hosts {
+		if !strings.HasPrefix(host, "*.") {
+			return 2
+		}
+	}
+	return 1
+}
@@ -0,0 +1,150 @@
+package proxycache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func namedHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	})
+}
+
+func TestRouter(t *testing.T) {
+	router, err := NewRouter(
+		&Route{Name: "default", Handler: namedHandler("default")},
+		&Route{Name: "api", Hosts: []string{"api.example.com"}, Handler: namedHandler("api")},
+		&Route{Name: "wildcard", Hosts: []string{"*.example.com"}, Handler: namedHandler("wildcard")},
+		&Route{Name: "static", PathPrefix: "/static/", Handler: namedHandler("static")},
+		&Route{Name: "admin", PathPrefix: "/static/admin", Methods: []string{http.MethodPost}, Handler: namedHandler("admin")},
+		&Route{Name: "beta", Headers: map[string]string{"X-Beta": "*"}, Query: map[string]string{"v": "2"}, Priority: 10, Handler: namedHandler("beta")},
+	)
+	require.NoError(t, err)
+
+	tests := []struct {
+		desc   string
+		method string
+		target string
+		header http.Header
+		want   string
+	}{
+		{desc: "no matcher", target: "http://www.other.com/", want: "default"},
+		{desc: "exact host", target: "http://api.example.com/", want: "api"},
+		{desc: "host is case insensitive and without port", target: "http://API.example.com:8080/", want: "api"},
+		{desc: "wildcard host", target: "http://www.example.com/", want: "wildcard"},
+		{desc: "wildcard does not match the domain", target: "http://example.com/", want: "default"},
+		{desc: "path prefix before host", target: "http://api.example.com/static/app.js", want: "static"},
+		{desc: "longest path prefix", method: http.MethodPost, target: "http://www.other.com/static/admin/upload", want: "admin"},
+		{desc: "method mismatch", target: "http://www.other.com/static/admin/upload", want: "static"},
+		{desc: "priority", target: "http://api.example.com/static/?v=2", header: http.Header{"X-Beta": {"1"}}, want: "beta"},
+		{desc: "query mismatch", target: "http://api.example.com/?v=1", header: http.Header{"X-Beta": {"1"}}, want: "api"},
+		{desc: "header mismatch", target: "http://api.example.com/?v=2", want: "api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.target, nil)
+			for key, values := range tt.header {
+				request.Header[key] = values
+			}
+			response := httptest.NewRecorder()
+
+			router.ServeHTTP(response, request)
+
+			assert.Equal(t, tt.want, response.Body.String())
+		})
+	}
+}
+
+func TestRouterNotFound(t *testing.T) {
+	router, err := NewRouter(&Route{Hosts: []string{"api.example.com"}, Handler: namedHandler("api")})
+	require.NoError(t, err)
+	response := httptest.NewRecorder()
+
+	router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil))
+
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+func TestNewRouter(t *testing.T) {
+	tests := []struct {
+		desc   string
+		routes []*Route
+	}{
+		{desc: "no route"},
+		{desc: "missing handler", routes: []*Route{{Name: "api"}}},
+		{desc: "invalid wildcard", routes: []*Route{{Hosts: []string{"api.*.com"}, Handler: namedHandler("api")}}},
+		{desc: "relative path prefix", routes: []*Route{{PathPrefix: "api", Handler: namedHandler("api")}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := NewRouter(tt.routes...)
+
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRouterSharedCache(t *testing.T) {
+	cache := NewInMemoryCache(10)
+	var origins []string
+	for _, name := range []string{"a", "b"} {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		})
+		defer server.Close()
+		origins = append(origins, server.URL)
+	}
+	router, err := NewRouter(
+		&Route{Hosts: []string{"a.example.com"}, Handler: newTestProxy(t, origins[0], WithMiddlewares(CacheMiddleware(cache)))},
+		&Route{Hosts: []string{"b.example.com"}, Handler: newTestProxy(t, origins[1], WithMiddlewares(CacheMiddleware(cache)))},
+	)
+	require.NoError(t, err)
+
+	for _, name := range []string{"a", "b", "a", "b"} {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://"+name+".example.com/", nil))
+
+		assert.Equal(t, name, response.Body.String())
+	}
+	keys, _ := cache.Keys()
+	assert.Len(t, keys, 2)
+}
+
+func TestRouterCacheRewrites(t *testing.T) {
+	cache := NewInMemoryCache(10)
+	var origins []string
+	for _, name := range []string{"api", "web"} {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.Path)
+		})
+		defer server.Close()
+		origins = append(origins, server.URL)
+	}
+	// both routes send /index.html upstream, the rewrites running before
+	// the cache
+	router, err := NewRouter(
+		&Route{Name: "api", PathPrefix: "/api/", Handler: newTestProxy(t, origins[0], WithMiddlewares(StripPrefix("/api"), CacheMiddleware(cache)))},
+		&Route{Name: "web", Handler: newTestProxy(t, origins[1], WithMiddlewares(CacheMiddleware(cache)))},
+	)
+	require.NoError(t, err)
+
+	for _, tt := range []struct{ target, want string }{
+		{target: "/api/index.html", want: "api /index.html"},
+		{target: "/index.html", want: "web /index.html"},
+		{target: "/api/index.html", want: "api /index.html"},
+		{target: "/index.html", want: "web /index.html"},
+	} {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+		assert.Equal(t, tt.want, response.Body.String(), tt.target)
+	}
+	keys, _ := cache.Keys()
+	assert.Len(t, keys, 2)
+}
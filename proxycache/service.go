@@ -0,0 +1,246 @@
+package proxycache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrNoUpstream is returned when a Service has no upstream available.
+var ErrNoUpstream = errors.New("no upstream available")
+
+// Upstream is one of the servers of a Service. It belongs to a single
+// Service, which keeps its state.
+type Upstream struct {
+	URL *url.URL
+	// Weight is the share of the requests sent to the upstream by the
+	// weighted strategies, relative to the other upstreams. Defaults to 1.
+	Weight int
+
+	active    atomic.Int64
+	requests  atomic.Int64
+	failures  atomic.Int64
+	unhealthy atomic.Bool
+	breaker   *breaker
+}
+
+// NewUpstream returns an upstream to rawURL, an absolute URL. http, https
+// and h2c ones, for a Proxy, may have a base path. tcp and udp ones, for a
+// TCPProxy or an UDPProxy, need a port.
+func NewUpstream(rawURL string, weight int) (*Upstream, error) {
+	u, err := parseOrigin(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Upstream{URL: u, Weight: max(weight, 1)}, nil
+}
+
+// Active returns the number of requests in flight to the upstream.
+func (u *Upstream) Active() int64 {
+	return u.active.Load()
+}
+
+// Requests returns the number of requests sent to the upstream, and
+// Failures the ones which failed with a transport error or a 5xx status.
+func (u *Upstream) Requests() int64 {
+	return u.requests.Load()
+}
+
+func (u *Upstream) Failures() int64 {
+	return u.failures.Load()
+}
+
+// CircuitState returns the state of the circuit breaker of the upstream,
+// always closed without WithCircuitBreaker.
+func (u *Upstream) CircuitState() CircuitState {
+	if u.breaker == nil {
+		return CircuitClosed
+	}
+	return u.breaker.currentState()
+}
+
+// Ejections returns how many times the circuit breaker opened.
+func (u *Upstream) Ejections() int64 {
+	if u.breaker == nil {
+		return 0
+	}
+	return u.breaker.ejections.Load()
+}
+
+// Healthy reports whether the upstream passes its health checks. Upstreams
+// are healthy until checked otherwise.
+func (u *Upstream) Healthy() bool {
+	return !u.unhealthy.Load()
+}
+
+func (u *Upstream) weight() int {
+	return max(u.Weight, 1)
+}
+
+// Service is a backend made of one or more upstreams, among which a
+// Balancer spreads the requests. A Service can be shared by several Proxy,
+// e.g. one per route.
+type Service struct {
+	upstreams      []*Upstream
+	balancer       Balancer
+	healthCheck    *HealthCheck
+	circuitBreaker *CircuitBreaker
+	sticky         *StickySessions
+}
+
+type ServiceOptions func(*Service)
+
+// NewService returns a Service balancing requests among upstreams, with
+// round-robin unless WithBalancer is given.
+func NewService(upstreams []*Upstream, options ...ServiceOptions) (*Service, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("invalid service: no upstream")
+	}
+	for _, upstream := range upstreams {
+		if upstream == nil || upstream.URL == nil {
+			return nil, errors.New("invalid service: missing upstream URL")
+		}
+	}
+	service := &Service{upstreams: upstreams, balancer: RoundRobin()}
+	for _, option := range options {
+		option(service)
+	}
+	if service.balancer == nil {
+		return nil, errors.New("invalid balancer: nil")
+	}
+	if service.healthCheck != nil {
+		if err := service.healthCheck.validate(upstreams); err != nil {
+			return nil, err
+		}
+	}
+	if service.sticky != nil {
+		if err := service.sticky.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if service.circuitBreaker != nil {
+		if err := service.circuitBreaker.validate(); err != nil {
+			return nil, err
+		}
+		for _, upstream := range upstreams {
+			upstream.breaker = newBreaker(service.circuitBreaker, upstream)
+		}
+	}
+	return service, nil
+}
+
+// WithBalancer sets the strategy picking the upstream of each request.
+func WithBalancer(balancer Balancer) ServiceOptions {
+	return func(s *Service) {
+		s.balancer = balancer
+	}
+}
+
+// Upstreams returns the upstreams of the service.
+func (s *Service) Upstreams() []*Upstream {
+	return s.upstreams
+}
+
+// checkSchemes fails when an upstream of the service has none of schemes,
+// as a proxy speaks a single protocol to all of them.
+func (s *Service) checkSchemes(schemes ...string) error {
+	for _, upstream := range s.upstreams {
+		if !slices.Contains(schemes, upstream.URL.Scheme) {
+			return fmt.Errorf("invalid upstream %s: scheme must be %s", upstream.URL, strings.Join(schemes, ", "))
+		}
+	}
+	return nil
+}
+
+// h2c reports whether some upstreams of the service use h2c.
+func (s *Service) h2c() bool {
+	return slices.ContainsFunc(s.upstreams, func(upstream *Upstream) bool {
+		return upstream.URL.Scheme == schemeH2C
+	})
+}
+
+// lease is an upstream picked for a request, released with its outcome.
+type lease struct {
+	upstream *Upstream
+	trial    bool
+	// cookie pins the client to upstream, with sticky sessions
+	cookie *http.Cookie
+}
+
+// outcome of a request, for the counters and the circuit breaker.
+type outcome int
+
+const (
+	outcomeNone outcome = iota // e.g. aborted by the client
+	outcomeSuccess
+	outcomeFailure
+)
+
+// pick returns the upstream of r among the healthy ones whose circuit is
+// not open, the one of its sticky session if any. The excluded upstreams,
+// already tried, are only picked again when no other is available.
+func (s *Service) pick(r *http.Request, exclude ...*Upstream) (*lease, error) {
+	available := make([]*Upstream, 0, len(s.upstreams))
+	for _, upstream := range s.upstreams {
+		if upstream.Healthy() && (upstream.breaker == nil || upstream.breaker.available()) {
+			available = append(available, upstream)
+		}
+	}
+	if others := slices.DeleteFunc(slices.Clone(available), func(u *Upstream) bool {
+		return slices.Contains(exclude, u)
+	}); len(others) > 0 {
+		available = others
+	}
+	var pinned *Upstream
+	var renew bool
+	if s.sticky != nil {
+		pinned, renew = s.sticky.upstream(r, available)
+	}
+	for len(available) > 0 {
+		upstream := pinned
+		if upstream == nil {
+			upstream = s.balancer.Pick(available, r)
+		}
+		if upstream == nil {
+			break
+		}
+		l := &lease{upstream: upstream}
+		if upstream.breaker != nil {
+			var ok bool
+			if l.trial, ok = upstream.breaker.acquire(); !ok {
+				// its trial requests were taken in the meantime
+				available = slices.DeleteFunc(available, func(u *Upstream) bool { return u == upstream })
+				pinned = nil
+				continue
+			}
+		}
+		if s.sticky != nil && (upstream != pinned || renew) {
+			l.cookie = s.sticky.cookie(upstream)
+		}
+		upstream.active.Add(1)
+		return l, nil
+	}
+	return nil, ErrNoUpstream
+}
+
+// release ends the request of the lease.
+func (l *lease) release(o outcome) {
+	l.upstream.active.Add(-1)
+	if o != outcomeNone {
+		l.upstream.requests.Add(1)
+	}
+	if o == outcomeFailure {
+		l.upstream.failures.Add(1)
+	}
+	if b := l.upstream.breaker; b != nil {
+		if o == outcomeNone {
+			b.release(l.trial)
+		} else {
+			b.record(l.trial, o == outcomeFailure)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package proxycache
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StickySessions pins the clients to an upstream with a cookie naming it,
+// for the applications keeping their sessions in memory. The cookie is
+// signed, so that clients cannot pick an upstream themselves, and is only
+// followed while its upstream is available.
+type StickySessions struct {
+	// Cookie is the name of the cookie, DefaultStickyCookie when empty.
+	Cookie string
+	// Secret signs the cookies. A random one is generated when empty, so
+	// that the sessions are rebalanced on restart.
+	Secret []byte
+	// TTL is the lifetime of the cookie, a session cookie when zero.
+	TTL      time.Duration
+	Path     string
+	Domain   string
+	Secure   bool
+	HTTPOnly bool
+	SameSite http.SameSite
+}
+
+const DefaultStickyCookie = "proxycache_sticky"
+
+// WithStickySessions enables the session affinity of the service.
+func WithStickySessions(sticky StickySessions) ServiceOptions {
+	return func(s *Service) {
+		if sticky.Cookie == "" {
+			sticky.Cookie = DefaultStickyCookie
+		}
+		if sticky.Path == "" {
+			sticky.Path = "/"
+		}
+		if len(sticky.Secret) == 0 {
+			sticky.Secret = make([]byte, 32)
+			rand.Read(sticky.Secret)
+		}
+		s.sticky = &sticky
+	}
+}
+
+func (sticky *StickySessions) validate() error {
+	if sticky.TTL < 0 {
+		return errors.New("invalid sticky sessions: negative TTL")
+	}
+	if err := (&http.Cookie{Name: sticky.Cookie}).Valid(); err != nil {
+		return fmt.Errorf("invalid sticky sessions: %w", err)
+	}
+	return nil
+}
+
+// stickyID identifies an upstream in the cookie without disclosing its URL.
+func stickyID(upstream *Upstream) string {
+	sum := sha256.Sum256([]byte(upstream.URL.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// upstream returns the upstream named by the cookie of r among upstreams,
+// nil when the cookie is missing, invalid or expired. The cookie is renewed
+// once half of its lifetime elapsed, so that active sessions stay pinned.
+func (sticky *StickySessions) upstream(r *http.Request, upstreams []*Upstream) (upstream *Upstream, renew bool) {
+	cookie, err := r.Cookie(sticky.Cookie)
+	if err != nil {
+		return nil, false
+	}
+	id, expires, ok := sticky.verify(cookie.Value)
+	if !ok {
+		return nil, false
+	}
+	if !expires.IsZero() {
+		left := time.Until(expires)
+		if left <= 0 {
+			return nil, false
+		}
+		renew = left < sticky.TTL/2
+	}
+	for _, upstream := range upstreams {
+		if stickyID(upstream) == id {
+			return upstream, renew
+		}
+	}
+	return nil, false
+}
+
+// cookie returns the cookie pinning the client to upstream.
+func (sticky *StickySessions) cookie(upstream *Upstream) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     sticky.Cookie,
+		Path:     sticky.Path,
+		Domain:   sticky.Domain,
+		Secure:   sticky.Secure,
+		HttpOnly: sticky.HTTPOnly,
+		SameSite: sticky.SameSite,
+	}
+	var expires time.Time
+	if sticky.TTL > 0 {
+		expires = time.Now().Add(sticky.TTL)
+		cookie.MaxAge = int(sticky.TTL.Seconds())
+	}
+	cookie.Value = sticky.sign(stickyID(upstream), expires)
+	return cookie
+}
+
+// sign returns the cookie value <id>.<expires>.<signature>, expires being
+// a Unix time or 0.
+func (sticky *StickySessions) sign(id string, expires time.Time) string {
+	var unix int64
+	if !expires.IsZero() {
+		unix = expires.Unix()
+	}
+	payload := id + "." + strconv.FormatInt(unix, 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sticky.mac(payload))
+}
+
+func (sticky *StickySessions) verify(value string) (id string, expires time.Time, ok bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", time.Time{}, false
+	}
+	payload := value[:i]
+	signature, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil || !hmac.Equal(signature, sticky.mac(payload)) {
+		return "", time.Time{}, false
+	}
+	id, rawExpires, _ := strings.Cut(payload, ".")
+	unix, err := strconv.ParseInt(rawExpires, 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	if unix != 0 {
+		expires = time.Unix(unix, 0)
+	}
+	return id, expires, true
+}
+
+func (sticky *StickySessions) mac(payload string) []byte {
+	h := hmac.New(sha256.New, sticky.Secret)
+	h.Write([]byte(sticky.Cookie + "=" + payload))
+	return h.Sum(nil)
+}
@@ -0,0 +1,122 @@
+package proxycache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStickyProxy(t *testing.T, sticky StickySessions) (*Proxy, []*Upstream) {
+	t.Helper()
+	var upstreams []*Upstream
+	for _, name := range []string{"a", "b", "c"} {
+		server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		})
+		t.Cleanup(server.Close)
+		upstream, err := NewUpstream(server.URL, 1)
+		require.NoError(t, err)
+		upstreams = append(upstreams, upstream)
+	}
+	service, err := NewService(upstreams, WithStickySessions(sticky))
+	require.NoError(t, err)
+	proxy, err := NewServiceProxy(service)
+	require.NoError(t, err)
+	return proxy, upstreams
+}
+
+func getWithCookies(proxy http.Handler, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	response := httptest.NewRecorder()
+	proxy.ServeHTTP(response, request)
+	return response
+}
+
+func stickyCookie(t *testing.T, response *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	cookies := response.Result().Cookies()
+	require.Len(t, cookies, 1)
+	return cookies[0]
+}
+
+func TestStickySessions(t *testing.T) {
+	t.Run("pinned", func(t *testing.T) {
+		proxy, _ := newStickyProxy(t, StickySessions{Cookie: "lb", TTL: time.Hour, Secure: true, HTTPOnly: true, SameSite: http.SameSiteLaxMode})
+		first := getWithCookies(proxy)
+		cookie := stickyCookie(t, first)
+
+		assert.Equal(t, "lb", cookie.Name)
+		assert.Equal(t, "/", cookie.Path)
+		assert.Equal(t, 3600, cookie.MaxAge)
+		assert.True(t, cookie.Secure)
+		assert.True(t, cookie.HttpOnly)
+		assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+		for range 5 {
+			response := getWithCookies(proxy, cookie)
+			assert.Equal(t, first.Body.String(), response.Body.String())
+			assert.Empty(t, response.Result().Cookies(), "not renewed")
+		}
+	})
+
+	t.Run("unavailable upstream", func(t *testing.T) {
+		proxy, upstreams := newStickyProxy(t, StickySessions{})
+		first := getWithCookies(proxy)
+		cookie := stickyCookie(t, first)
+		for _, upstream := range upstreams {
+			upstream.unhealthy.Store(stickyID(upstream) == cookie.Value[:16])
+		}
+
+		response := getWithCookies(proxy, cookie)
+
+		assert.NotEqual(t, first.Body.String(), response.Body.String())
+		assert.NotEqual(t, cookie.Value, stickyCookie(t, response).Value, "pinned to the new upstream")
+	})
+
+	t.Run("forged cookie", func(t *testing.T) {
+		proxy, upstreams := newStickyProxy(t, StickySessions{Secret: []byte("secret")})
+		other := &StickySessions{Cookie: DefaultStickyCookie, Secret: []byte("other")}
+		forged := other.cookie(upstreams[2])
+
+		for range 3 {
+			stickyCookie(t, getWithCookies(proxy, forged)) // a new cookie every time
+		}
+	})
+
+	t.Run("expired cookie", func(t *testing.T) {
+		sticky := &StickySessions{Cookie: DefaultStickyCookie, Secret: []byte("secret"), TTL: time.Hour}
+		proxy, upstreams := newStickyProxy(t, *sticky)
+		expired := &http.Cookie{Name: DefaultStickyCookie, Value: sticky.sign(stickyID(upstreams[0]), time.Now().Add(-time.Second))}
+
+		stickyCookie(t, getWithCookies(proxy, expired))
+	})
+
+	t.Run("renewed", func(t *testing.T) {
+		sticky := &StickySessions{Cookie: DefaultStickyCookie, Secret: []byte("secret"), TTL: time.Hour}
+		proxy, upstreams := newStickyProxy(t, *sticky)
+		old := &http.Cookie{Name: DefaultStickyCookie, Value: sticky.sign(stickyID(upstreams[1]), time.Now().Add(10*time.Minute))}
+
+		response := getWithCookies(proxy, old)
+
+		assert.Equal(t, "b", response.Body.String())
+		id, expires, ok := sticky.verify(stickyCookie(t, response).Value)
+		assert.True(t, ok)
+		assert.Equal(t, stickyID(upstreams[1]), id)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), expires, time.Minute)
+	})
+}
+
+func TestStickySessionsValidation(t *testing.T) {
+	_, err := NewService(newTestUpstreams(t, 1), WithStickySessions(StickySessions{Cookie: "bad name"}))
+	assert.Error(t, err)
+
+	_, err = NewService(newTestUpstreams(t, 1), WithStickySessions(StickySessions{TTL: -time.Second}))
+	assert.Error(t, err)
+}
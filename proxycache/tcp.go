@@ -0,0 +1,288 @@
+package proxycache
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	schemeTCP = "tcp"
+	schemeUDP = "udp"
+
+	// clientHelloTimeout bounds the wait for the ClientHello of SNI routing.
+	clientHelloTimeout = 10 * time.Second
+)
+
+// TCPProxy forwards TCP connections to the upstreams of a Service, e.g. to
+// front databases. With SNI routes, TLS connections are routed on the
+// server name of their ClientHello and forwarded as is, TLS being
+// terminated by the upstream (passthrough).
+type TCPProxy struct {
+	service     *Service
+	sniRoutes   []sniRoute
+	dialTimeout time.Duration
+	idleTimeout time.Duration
+}
+
+type sniRoute struct {
+	serverName string
+	service    *Service
+}
+
+type TCPProxyOptions func(*TCPProxy)
+
+// WithSNIRoute forwards the TLS connections to serverName to service. A
+// server name starting with "*." matches any of its subdomains, exact ones
+// and then the longest ones taking precedence. Clients must speak first,
+// as TLS ones do.
+func WithSNIRoute(serverName string, service *Service) TCPProxyOptions {
+	return func(p *TCPProxy) {
+		p.sniRoutes = append(p.sniRoutes, sniRoute{serverName: serverName, service: service})
+	}
+}
+
+// WithTCPDialTimeout sets the timeout to connect to an upstream, 30 seconds
+// by default. Zero means no timeout.
+func WithTCPDialTimeout(timeout time.Duration) TCPProxyOptions {
+	return func(p *TCPProxy) {
+		p.dialTimeout = timeout
+	}
+}
+
+// WithTCPIdleTimeout closes the connections on which nothing was sent in
+// either direction for timeout. Zero keeps them open until one of the sides
+// closes.
+func WithTCPIdleTimeout(timeout time.Duration) TCPProxyOptions {
+	return func(p *TCPProxy) {
+		p.idleTimeout = timeout
+	}
+}
+
+// NewTCPProxy returns a TCP proxy to service, whose upstreams must be tcp
+// ones. service may be nil with SNI routes, the connections matching none
+// are then closed.
+func NewTCPProxy(service *Service, options ...TCPProxyOptions) (*TCPProxy, error) {
+	proxy := &TCPProxy{service: service, dialTimeout: 30 * time.Second}
+	for _, option := range options {
+		option(proxy)
+	}
+	if err := proxy.validate(); err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(proxy.sniRoutes, func(a, b sniRoute) int {
+		return cmp.Or(
+			cmp.Compare(hostSpecificity([]string{b.serverName}), hostSpecificity([]string{a.serverName})),
+			cmp.Compare(len(b.serverName), len(a.serverName)),
+		)
+	})
+	return proxy, nil
+}
+
+func (p *TCPProxy) validate() error {
+	if p.service == nil && len(p.sniRoutes) == 0 {
+		return errors.New("invalid service: nil")
+	}
+	if p.dialTimeout < 0 || p.idleTimeout < 0 {
+		return errors.New("invalid TCP proxy: negative timeout")
+	}
+	for _, route := range p.sniRoutes {
+		if route.serverName == "" || strings.Contains(strings.TrimPrefix(route.serverName, "*."), "*") {
+			return fmt.Errorf("invalid SNI route: invalid server name %q", route.serverName)
+		}
+		if route.service == nil {
+			return fmt.Errorf("invalid SNI route %q: nil service", route.serverName)
+		}
+		if err := checkL4Service(route.service, schemeTCP); err != nil {
+			return err
+		}
+	}
+	if p.service != nil {
+		return checkL4Service(p.service, schemeTCP)
+	}
+	return nil
+}
+
+// checkL4Service fails when service cannot be used by a TCPProxy or an
+// UDPProxy speaking scheme.
+func checkL4Service(service *Service, scheme string) error {
+	if err := service.checkSchemes(scheme); err != nil {
+		return err
+	}
+	if service.sticky != nil {
+		return errors.New("invalid service: sticky sessions need HTTP")
+	}
+	return nil
+}
+
+// Serve accepts the connections of ln and forwards them, until ln is
+// closed.
+func (p *TCPProxy) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go p.ServeConn(conn)
+	}
+}
+
+// ServeConn forwards conn to an upstream, trying the next ones when the
+// connection fails, then closes it.
+func (p *TCPProxy) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	service, client := p.service, io.Reader(conn)
+	var serverName string
+	if len(p.sniRoutes) > 0 {
+		conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+		var err error
+		serverName, client, err = peekServerName(conn)
+		if err != nil {
+			log.Printf("error reading TLS ClientHello from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		service = p.route(serverName)
+		if service == nil {
+			log.Printf("no TCP route for server name %q from %s", serverName, conn.RemoteAddr())
+			return
+		}
+	}
+
+	r := connRequest(conn.RemoteAddr(), serverName)
+	dialer := &net.Dialer{Timeout: p.dialTimeout}
+	var tried []*Upstream
+	for range service.upstreams {
+		lease, err := service.pick(r, tried...)
+		if err != nil {
+			log.Printf("error picking TCP upstream for %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		if slices.Contains(tried, lease.upstream) {
+			lease.release(outcomeNone)
+			break
+		}
+		tried = append(tried, lease.upstream)
+
+		backend, err := dialer.DialContext(context.Background(), "tcp", lease.upstream.URL.Host)
+		if err != nil {
+			log.Printf("error connecting to TCP upstream %s: %v", lease.upstream.URL, err)
+			lease.release(outcomeFailure)
+			continue
+		}
+		log.Printf("connection: %s -> %s", conn.RemoteAddr(), lease.upstream.URL)
+		pipe(conn, client, backend, p.idleTimeout)
+		lease.release(outcomeSuccess)
+		return
+	}
+	log.Printf("no TCP upstream reachable for %s", conn.RemoteAddr())
+}
+
+// route returns the service of the connections to serverName, the default
+// one when no SNI route matches.
+func (p *TCPProxy) route(serverName string) *Service {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if serverName != "" {
+		for _, route := range p.sniRoutes {
+			if matchHost(route.serverName, serverName) {
+				return route.service
+			}
+		}
+	}
+	return p.service
+}
+
+// connRequest describes a connection to the balancers, written for HTTP
+// requests: only the client address and the TLS server name can be hashed.
+func connRequest(remote net.Addr, serverName string) *http.Request {
+	return &http.Request{RemoteAddr: remote.String(), Host: serverName, URL: &url.URL{}, Header: http.Header{}}
+}
+
+// pipe copies the bytes read from client to backend and back, until both
+// directions are done. The end of one direction is forwarded as a
+// half-close, as some protocols wait for it before answering.
+func pipe(conn net.Conn, client io.Reader, backend net.Conn, idleTimeout time.Duration) {
+	var once sync.Once
+	closeAll := func() {
+		once.Do(func() {
+			conn.Close()
+			backend.Close()
+		})
+	}
+	defer closeAll()
+	idle := newIdleTimer(idleTimeout, closeAll)
+	defer idle.stop()
+
+	copyHalf := func(dst net.Conn, src io.Reader) {
+		if _, err := io.Copy(idleWriter{dst, idle}, src); err != nil {
+			closeAll() // the other direction would never end
+			return
+		}
+		if c, ok := dst.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		} else {
+			closeAll()
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyHalf(backend, client)
+	}()
+	go func() {
+		defer wg.Done()
+		copyHalf(conn, backend)
+	}()
+	wg.Wait()
+}
+
+// errClientHello stops the TLS handshake of peekServerName.
+var errClientHello = errors.New("ClientHello read")
+
+// peekServerName reads the TLS ClientHello at the start of conn and returns
+// its server name, empty when the client sent none or does not speak TLS.
+// The returned reader replays the bytes read before reading conn.
+func peekServerName(conn net.Conn) (string, io.Reader, error) {
+	var peeked bytes.Buffer
+	var serverName string
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHello
+		},
+	}).Handshake()
+
+	var netErr net.Error
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return "", nil, err
+	}
+	// any other error means that the client does not speak TLS
+	return serverName, io.MultiReader(&peeked, conn), nil
+}
+
+// readOnlyConn lets crypto/tls read a ClientHello without answering it.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c readOnlyConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
@@ -0,0 +1,224 @@
+package proxycache
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTCPUpstream accepts connections with serve and returns its upstream.
+func newTCPUpstream(t *testing.T, serve func(net.Conn)) *Upstream {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	upstream, err := NewUpstream("tcp://"+ln.Addr().String(), 1)
+	require.NoError(t, err)
+	return upstream
+}
+
+// prefixEcho echoes what it reads once the client is done writing,
+// prefixed with name.
+func prefixEcho(name string) func(net.Conn) {
+	return func(conn net.Conn) {
+		data, _ := io.ReadAll(conn)
+		io.WriteString(conn, name+":"+string(data))
+	}
+}
+
+func newL4Service(t *testing.T, upstreams ...*Upstream) *Service {
+	t.Helper()
+	service, err := NewService(upstreams)
+	require.NoError(t, err)
+	return service
+}
+
+// serveTCP serves proxy on a loopback port and returns its address.
+func serveTCP(t *testing.T, proxy *TCPProxy) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go proxy.Serve(ln)
+	return ln.Addr().String()
+}
+
+// exchange sends message, half-closes the connection and returns the
+// answer.
+func exchange(t *testing.T, conn net.Conn, message string) string {
+	t.Helper()
+	_, err := io.WriteString(conn, message)
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	answer, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return string(answer)
+}
+
+func TestTCPProxy(t *testing.T) {
+	t.Run("half-close", func(t *testing.T) {
+		proxy, err := NewTCPProxy(newL4Service(t, newTCPUpstream(t, prefixEcho("a"))))
+		require.NoError(t, err)
+		conn, err := net.Dial("tcp", serveTCP(t, proxy))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		assert.Equal(t, "a:hello", exchange(t, conn, "hello"))
+	})
+
+	t.Run("unreachable upstream", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		ln.Close() // nothing listens anymore
+		down, err := NewUpstream("tcp://"+ln.Addr().String(), 1)
+		require.NoError(t, err)
+		up := newTCPUpstream(t, prefixEcho("up"))
+		proxy, err := NewTCPProxy(newL4Service(t, down, up))
+		require.NoError(t, err)
+		addr := serveTCP(t, proxy)
+
+		for range 4 {
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			assert.Equal(t, "up:hi", exchange(t, conn, "hi"))
+			conn.Close()
+		}
+		assert.NotZero(t, down.Failures())
+		assert.Eventually(t, func() bool { return up.Active() == 0 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		proxy, err := NewTCPProxy(newL4Service(t, newTCPUpstream(t, prefixEcho("a"))), WithTCPIdleTimeout(50*time.Millisecond))
+		require.NoError(t, err)
+		conn, err := net.Dial("tcp", serveTCP(t, proxy))
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		_, err = conn.Read(make([]byte, 1))
+
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("health check", func(t *testing.T) {
+		check := DefaultHealthCheck()
+		up := newTCPUpstream(t, func(net.Conn) {})
+
+		assert.NoError(t, check.probe(context.Background(), nil, up))
+		up.URL.Host = "127.0.0.1:1"
+		assert.Error(t, check.probe(context.Background(), nil, up))
+	})
+}
+
+func TestTCPProxySNI(t *testing.T) {
+	// the upstreams terminate TLS and answer with their name
+	cert := httptest.NewTLSServer(nil)
+	cert.Close()
+	tlsUpstream := func(name string) *Upstream {
+		return newTCPUpstream(t, func(conn net.Conn) {
+			tlsConn := tls.Server(conn, cert.TLS)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			io.WriteString(tlsConn, name+":"+tlsConn.ConnectionState().ServerName+"\n")
+		})
+	}
+	proxy, err := NewTCPProxy(newL4Service(t, newTCPUpstream(t, prefixEcho("default"))),
+		WithSNIRoute("*.example.com", newL4Service(t, tlsUpstream("wildcard"))),
+		WithSNIRoute("db.example.com", newL4Service(t, tlsUpstream("db"))),
+	)
+	require.NoError(t, err)
+	addr := serveTCP(t, proxy)
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{serverName: "db.example.com", want: "db:db.example.com\n"},
+		{serverName: "DB.example.com", want: "db:DB.example.com\n"},
+		{serverName: "cache.example.com", want: "wildcard:cache.example.com\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+			require.NoError(t, err)
+			defer conn.Close()
+
+			line, err := bufio.NewReader(conn).ReadString('\n')
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, line)
+		})
+	}
+
+	t.Run("not TLS", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		assert.Equal(t, "default:plain text", exchange(t, conn, "plain text"))
+	})
+
+	t.Run("no route", func(t *testing.T) {
+		proxy, err := NewTCPProxy(nil, WithSNIRoute("db.example.com", newL4Service(t, tlsUpstream("db"))))
+		require.NoError(t, err)
+
+		_, err = tls.Dial("tcp", serveTCP(t, proxy), &tls.Config{ServerName: "other.example.com", InsecureSkipVerify: true})
+
+		assert.Error(t, err)
+	})
+}
+
+func TestNewTCPProxy(t *testing.T) {
+	tcp := newL4Service(t, newTCPUpstream(t, prefixEcho("a")))
+	udp, err := NewUpstream("udp://127.0.0.1:53", 1)
+	require.NoError(t, err)
+	sticky, err := NewService([]*Upstream{newTCPUpstream(t, prefixEcho("a"))}, WithStickySessions(StickySessions{}))
+	require.NoError(t, err)
+
+	tests := []struct {
+		desc    string
+		service *Service
+		options []TCPProxyOptions
+		wantErr string
+	}{
+		{desc: "valid", service: tcp},
+		{desc: "SNI routes only", options: []TCPProxyOptions{WithSNIRoute("*.example.com", tcp)}},
+		{desc: "no service", wantErr: "invalid service"},
+		{desc: "udp upstream", service: newL4Service(t, udp), wantErr: "scheme must be tcp"},
+		{desc: "sticky sessions", service: sticky, wantErr: "sticky sessions need HTTP"},
+		{desc: "negative timeout", service: tcp, options: []TCPProxyOptions{WithTCPIdleTimeout(-time.Second)}, wantErr: "negative timeout"},
+		{desc: "invalid server name", service: tcp, options: []TCPProxyOptions{WithSNIRoute("db.*.com", tcp)}, wantErr: "invalid server name"},
+		{desc: "nil SNI service", service: tcp, options: []TCPProxyOptions{WithSNIRoute("db.example.com", nil)}, wantErr: "nil service"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := NewTCPProxy(tt.service, tt.options...)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package proxycache
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// TransportOptions configures the connections of the Proxy to its upstream.
+// Zero durations and limits mean no timeout and no limit.
+type TransportOptions struct {
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	TLSClientConfig       *tls.Config
+}
+
+// DefaultTransportOptions returns the options used when none are given,
+// close to the ones of http.DefaultTransport.
+func DefaultTransportOptions() TransportOptions {
+	return TransportOptions{
+		DialTimeout:         30 * time.Second,
+		KeepAlive:           30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 32,
+	}
+}
+
+// WithTransportOptions replaces the options of the upstream transport.
+func WithTransportOptions(options TransportOptions) ProxyOptions {
+	return func(p *Proxy) {
+		p.transport = NewTransport(options)
+	}
+}
+
+// WithTransport replaces the upstream transport, e.g. for tests or to wrap
+// it with instrumentation.
+func WithTransport(transport http.RoundTripper) ProxyOptions {
+	return func(p *Proxy) {
+		p.transport = transport
+	}
+}
+
+// NewTransport returns the transport built from options, which can be
+// shared by several Proxy and health checks with WithTransport.
+func NewTransport(options TransportOptions) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   options.DialTimeout,
+		KeepAlive: options.KeepAlive,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       options.TLSClientConfig,
+		TLSHandshakeTimeout:   options.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: options.ResponseHeaderTimeout,
+		IdleConnTimeout:       options.IdleConnTimeout,
+		MaxIdleConns:          options.MaxIdleConns,
+		MaxIdleConnsPerHost:   options.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       options.MaxConnsPerHost,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+}
+
+// schemeH2C is the scheme of the upstreams reached with HTTP/2 over
+// cleartext TCP, with prior knowledge, e.g. internal gRPC services.
+const schemeH2C = "h2c"
+
+// upstreamScheme returns the scheme of the requests sent to an upstream
+// URL, h2c upstreams being plain http ones.
+func upstreamScheme(u *url.URL) string {
+	if u.Scheme == schemeH2C {
+		return "http"
+	}
+	return u.Scheme
+}
+
+// h2cTransport returns a copy of transport speaking HTTP/2 only, without
+// TLS, to the http URLs. Other round trippers cannot be converted.
+func h2cTransport(transport http.RoundTripper) (*http.Transport, error) {
+	t, ok := transport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("h2c upstreams need an *http.Transport")
+	}
+	t = t.Clone()
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return t, nil
+}
+
+// newClient returns the client calling the upstream. A reverse proxy must
+// not follow redirects, they are returned to the client as is.
+func newClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
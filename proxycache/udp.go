@@ -0,0 +1,166 @@
+package proxycache
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxDatagramSize is the largest UDP payload.
+const maxDatagramSize = 64 * 1024
+
+// UDPProxy forwards UDP datagrams to the upstreams of a Service, e.g. to
+// front DNS servers. The datagrams of a client address belong to a session,
+// bound to a single upstream, which ends when no datagram was sent in either
+// direction for the idle timeout.
+type UDPProxy struct {
+	service     *Service
+	idleTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+type UDPProxyOptions func(*UDPProxy)
+
+// WithUDPIdleTimeout sets how long a session lasts without datagrams, 30
+// seconds by default.
+func WithUDPIdleTimeout(timeout time.Duration) UDPProxyOptions {
+	return func(p *UDPProxy) {
+		p.idleTimeout = timeout
+	}
+}
+
+// NewUDPProxy returns an UDP proxy to service, whose upstreams must be udp
+// ones.
+func NewUDPProxy(service *Service, options ...UDPProxyOptions) (*UDPProxy, error) {
+	if service == nil {
+		return nil, errors.New("invalid service: nil")
+	}
+	proxy := &UDPProxy{service: service, idleTimeout: 30 * time.Second, sessions: map[string]*udpSession{}}
+	for _, option := range options {
+		option(proxy)
+	}
+	if proxy.idleTimeout <= 0 {
+		return nil, errors.New("invalid UDP idle timeout: must be positive")
+	}
+	if err := checkL4Service(service, schemeUDP); err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// udpSession is the exchange of a client with its upstream, through a
+// socket connected to the upstream.
+type udpSession struct {
+	key     string
+	lease   *lease
+	backend net.Conn
+	idle    *idleTimer
+	failed  atomic.Bool
+}
+
+// Serve reads the datagrams of conn and forwards them, until conn is closed.
+// The sessions are then ended.
+func (p *UDPProxy) Serve(conn net.PacketConn) error {
+	defer p.endAll()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		session, err := p.session(conn, addr)
+		if err != nil {
+			log.Printf("error forwarding UDP datagram from %s: %v", addr, err)
+			continue
+		}
+		session.idle.reset()
+		if _, err := session.backend.Write(buf[:n]); err != nil {
+			log.Printf("error forwarding UDP datagram to %s: %v", session.lease.upstream.URL, err)
+		}
+	}
+}
+
+// session returns the session of the client at addr, starting it with a
+// new upstream when needed.
+func (p *UDPProxy) session(conn net.PacketConn, addr net.Addr) (*udpSession, error) {
+	key := addr.String()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if session, ok := p.sessions[key]; ok {
+		return session, nil
+	}
+
+	lease, err := p.service.pick(connRequest(addr, ""))
+	if err != nil {
+		return nil, err
+	}
+	backend, err := net.Dial("udp", lease.upstream.URL.Host)
+	if err != nil {
+		lease.release(outcomeFailure)
+		return nil, err
+	}
+	log.Printf("UDP session: %s -> %s", key, lease.upstream.URL)
+	session := &udpSession{key: key, lease: lease, backend: backend}
+	session.idle = newIdleTimer(p.idleTimeout, func() { p.end(session) })
+	p.sessions[key] = session
+	go p.reply(conn, addr, session)
+	return session, nil
+}
+
+// reply sends the datagrams of the upstream back to the client, until the
+// session ends.
+func (p *UDPProxy) reply(conn net.PacketConn, addr net.Addr, session *udpSession) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := session.backend.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				// e.g. connection refused, the upstream does not listen
+				log.Printf("error reading UDP upstream %s: %v", session.lease.upstream.URL, err)
+				session.failed.Store(true)
+				p.end(session)
+			}
+			return
+		}
+		session.idle.reset()
+		if _, err := conn.WriteTo(buf[:n], addr); err != nil {
+			log.Printf("error replying to UDP client %s: %v", addr, err)
+		}
+	}
+}
+
+// end ends session, once, and releases its upstream.
+func (p *UDPProxy) end(session *udpSession) {
+	p.mu.Lock()
+	if p.sessions[session.key] != session {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.sessions, session.key)
+	p.mu.Unlock()
+
+	session.idle.stop()
+	session.backend.Close()
+	if session.failed.Load() {
+		session.lease.release(outcomeFailure)
+	} else {
+		session.lease.release(outcomeSuccess)
+	}
+}
+
+func (p *UDPProxy) endAll() {
+	p.mu.Lock()
+	sessions := make([]*udpSession, 0, len(p.sessions))
+	for _, session := range p.sessions {
+		sessions = append(sessions, session)
+	}
+	p.mu.Unlock()
+	for _, session := range sessions {
+		p.end(session)
+	}
+}
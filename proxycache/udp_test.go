@@ -0,0 +1,121 @@
+package proxycache
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUDPUpstream answers each datagram with name and the datagram.
+func newUDPUpstream(t *testing.T, name string) *Upstream {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte(name+":"), buf[:n]...), addr)
+		}
+	}()
+	upstream, err := NewUpstream("udp://"+conn.LocalAddr().String(), 1)
+	require.NoError(t, err)
+	return upstream
+}
+
+// serveUDP serves proxy on a loopback port and returns its address.
+func serveUDP(t *testing.T, proxy *UDPProxy) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go proxy.Serve(conn)
+	return conn.LocalAddr().String()
+}
+
+func udpExchange(t *testing.T, conn net.Conn, message string) string {
+	t.Helper()
+	_, err := conn.Write([]byte(message))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, maxDatagramSize)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestUDPProxy(t *testing.T) {
+	t.Run("sessions", func(t *testing.T) {
+		a, b := newUDPUpstream(t, "a"), newUDPUpstream(t, "b")
+		proxy, err := NewUDPProxy(newL4Service(t, a, b))
+		require.NoError(t, err)
+		addr := serveUDP(t, proxy)
+
+		seen := map[string]bool{}
+		for range 2 {
+			conn, err := net.Dial("udp", addr)
+			require.NoError(t, err)
+			defer conn.Close()
+			first := udpExchange(t, conn, "ping")
+			for range 3 {
+				assert.Equal(t, first, udpExchange(t, conn, "ping"), "same upstream for the session")
+			}
+			seen[first] = true
+		}
+
+		assert.Equal(t, map[string]bool{"a:ping": true, "b:ping": true}, seen)
+		assert.Equal(t, int64(1), a.Active())
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		a := newUDPUpstream(t, "a")
+		proxy, err := NewUDPProxy(newL4Service(t, a), WithUDPIdleTimeout(50*time.Millisecond))
+		require.NoError(t, err)
+		conn, err := net.Dial("udp", serveUDP(t, proxy))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		assert.Equal(t, "a:ping", udpExchange(t, conn, "ping"))
+		assert.Eventually(t, func() bool { return a.Active() == 0 }, time.Second, time.Millisecond)
+		assert.Equal(t, int64(1), a.Requests())
+		assert.Zero(t, a.Failures())
+		assert.Equal(t, "a:again", udpExchange(t, conn, "again"), "new session")
+	})
+
+	t.Run("unreachable upstream", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		conn.Close() // nothing listens anymore
+		down, err := NewUpstream("udp://"+conn.LocalAddr().String(), 1)
+		require.NoError(t, err)
+		proxy, err := NewUDPProxy(newL4Service(t, down))
+		require.NoError(t, err)
+		client, err := net.Dial("udp", serveUDP(t, proxy))
+		require.NoError(t, err)
+		defer client.Close()
+
+		client.Write([]byte("ping"))
+
+		assert.Eventually(t, func() bool { return down.Failures() == 1 }, time.Second, time.Millisecond)
+	})
+}
+
+func TestNewUDPProxy(t *testing.T) {
+	udp := newL4Service(t, newUDPUpstream(t, "a"))
+
+	_, err := NewUDPProxy(nil)
+	assert.ErrorContains(t, err, "invalid service")
+	_, err = NewUDPProxy(newL4Service(t, newTCPUpstream(t, prefixEcho("a"))))
+	assert.ErrorContains(t, err, "scheme must be udp")
+	_, err = NewUDPProxy(udp, WithUDPIdleTimeout(0))
+	assert.ErrorContains(t, err, "invalid UDP idle timeout")
+	_, err = NewService(udp.upstreams, WithHealthCheck(HealthCheck{}))
+	assert.ErrorContains(t, err, "cannot be probed")
+}
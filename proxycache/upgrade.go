@@ -0,0 +1,120 @@
+package proxycache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WithUpgradeIdleTimeout closes the upgraded connections, e.g. WebSockets,
+// on which nothing was sent in either direction for timeout. Zero keeps
+// them open until one of the sides closes.
+func WithUpgradeIdleTimeout(timeout time.Duration) ProxyOptions {
+	return func(p *Proxy) {
+		p.upgradeIdleTimeout = timeout
+	}
+}
+
+// switchProtocols handles a 101 Switching Protocols response: the client
+// connection is hijacked and the bytes are copied in both directions, until
+// one of the sides closes or the connection stays idle for too long.
+func (p *Proxy) switchProtocols(w http.ResponseWriter, r *http.Request, resp *http.Response) error {
+	requested, switched := upgradeType(r.Header), upgradeType(resp.Header)
+	if !strings.EqualFold(requested, switched) {
+		return fmt.Errorf("upstream switched to protocol %q when %q was requested", switched, requested)
+	}
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return errors.New("upstream response body is not writable")
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return fmt.Errorf("client connection cannot switch protocols: %w", err)
+	}
+	defer conn.Close()
+	// the deadlines of the server do not apply to the new protocol
+	conn.SetDeadline(time.Time{})
+
+	resp.Header = w.Header()
+	resp.Body = nil // only write the header, the body is the connection
+	if err := resp.Write(brw); err != nil {
+		log.Printf("error writing switching protocols response: %v", err)
+		return nil
+	}
+	if err := brw.Flush(); err != nil {
+		log.Printf("error writing switching protocols response: %v", err)
+		return nil
+	}
+
+	var once sync.Once
+	closeAll := func() {
+		once.Do(func() {
+			conn.Close()
+			backConn.Close()
+		})
+	}
+	defer closeAll()
+	idle := newIdleTimer(p.upgradeIdleTimeout, func() {
+		log.Printf("closing idle %s connection: %s", requested, r.URL.String())
+		closeAll()
+	})
+	defer idle.stop()
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(idleWriter{backConn, idle}, brw.Reader)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(idleWriter{conn, idle}, backConn)
+		errc <- err
+	}()
+	select {
+	case <-errc:
+	case <-r.Context().Done():
+	}
+	return nil
+}
+
+// idleTimer calls a function once nothing was written for a timeout.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimer(timeout time.Duration, f func()) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, f)
+	}
+	return t
+}
+
+func (t *idleTimer) reset() {
+	if t.timer != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// idleWriter resets an idleTimer on each write.
+type idleWriter struct {
+	io.Writer
+	idle *idleTimer
+}
+
+func (w idleWriter) Write(p []byte) (int, error) {
+	w.idle.reset()
+	return w.Writer.Write(p)
+}
@@ -0,0 +1,90 @@
+package proxycache
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoUpgradeHandler switches to protocol, whatever the client asked, then
+// echoes what it receives.
+func echoUpgradeHandler(protocol string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + protocol + "\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}
+}
+
+// dialUpgrade sends an Upgrade request to addr and returns the connection
+// and the response.
+func dialUpgrade(t *testing.T, addr, protocol string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Write([]byte("GET /chat HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: " + protocol + "\r\n\r\n"))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	return conn, br, resp
+}
+
+func TestUpgrade(t *testing.T) {
+	newServer := func(t *testing.T, protocol string, options ...ProxyOptions) *httptest.Server {
+		upstream := httptest.NewServer(echoUpgradeHandler(protocol))
+		t.Cleanup(upstream.Close)
+		cache := NewInMemoryCache(10)
+		proxy := newTestProxy(t, upstream.URL, append(options, WithMiddlewares(CacheMiddleware(cache)))...)
+		server := httptest.NewServer(proxy)
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	t.Run("echo", func(t *testing.T) {
+		server := newServer(t, "echo", WithUpstreamTimeout(50*time.Millisecond))
+		conn, br, resp := dialUpgrade(t, server.Listener.Addr().String(), "echo")
+
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		assert.Equal(t, "echo", resp.Header.Get("Upgrade"))
+		assert.Equal(t, "BYPASS", resp.Header.Get("X-Cache-Status"))
+		time.Sleep(100 * time.Millisecond) // past the upstream timeout
+		for _, message := range []string{"hello\n", "world\n"} {
+			_, err := conn.Write([]byte(message))
+			require.NoError(t, err)
+			line, err := br.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, message, line)
+		}
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		server := newServer(t, "echo", WithUpgradeIdleTimeout(50*time.Millisecond))
+		conn, br, _ := dialUpgrade(t, server.Listener.Addr().String(), "echo")
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		_, err := br.ReadByte()
+
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("protocol mismatch", func(t *testing.T) {
+		server := newServer(t, "other")
+		_, _, resp := dialUpgrade(t, server.Listener.Addr().String(), "echo")
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+}
@@ -0,0 +1,172 @@
+package proxycache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WarmResult is the outcome of warming one URL.
+type WarmResult struct {
+	URL         string
+	StatusCode  int
+	CacheStatus string
+	Duration    time.Duration
+	Err         error
+}
+
+// Warmer fills the cache of a running proxy by requesting a list of URLs
+// through it.
+type Warmer struct {
+	Client      *http.Client
+	Concurrency int     // parallel requests, at least 1
+	Rate        float64 // requests per second, unlimited when <= 0 or above 1e9
+}
+
+// Warm requests every URL through the proxy at target and calls report with
+// the result of each one. Absolute URLs keep their host as Host header, so
+// that sitemaps of the origin can be used as is.
+func (w *Warmer) Warm(ctx context.Context, target *url.URL, urls []string, report func(WarmResult)) {
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	concurrency := max(w.Concurrency, 1)
+
+	var tick <-chan time.Time
+	// rates above one request per nanosecond are as good as unlimited
+	if interval := time.Duration(float64(time.Second) / w.Rate); w.Rate > 0 && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	jobs := make(chan string)
+	results := make(chan WarmResult)
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range jobs {
+				results <- warmURL(ctx, client, target, u)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	go func() {
+		defer close(jobs)
+		for i, u := range urls {
+			if tick != nil && i > 0 {
+				select {
+				case <-tick:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case jobs <- u:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for result := range results {
+		report(result)
+	}
+}
+
+func warmURL(ctx context.Context, client *http.Client, target *url.URL, rawURL string) (result WarmResult) {
+	result.URL = rawURL
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	dest := *target
+	dest.Path = u.Path
+	dest.RawPath = u.RawPath
+	dest.RawQuery = u.RawQuery
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dest.String(), nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if u.Host != "" {
+		req.Host = u.Host
+	}
+	req.Header.Set("User-Agent", "proxycache-warmer")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	result.StatusCode = resp.StatusCode
+	result.CacheStatus = resp.Header.Get("X-Cache-Status")
+	result.Err = err
+	return result
+}
+
+type sitemap struct {
+	XMLName xml.Name
+	URLs    []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+}
+
+// ReadWarmList reads the URLs to warm, either from a sitemap.xml or from a
+// plain list with one URL per line. Blank lines and lines starting with #
+// are ignored.
+func ReadWarmList(r io.Reader) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		var s sitemap
+		if err := xml.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("error parsing sitemap: %w", err)
+		}
+		if s.XMLName.Local != "urlset" {
+			return nil, fmt.Errorf("unsupported sitemap root element %q, want urlset", s.XMLName.Local)
+		}
+		var urls []string
+		for _, u := range s.URLs {
+			if loc := strings.TrimSpace(u.Loc); loc != "" {
+				urls = append(urls, loc)
+			}
+		}
+		return urls, nil
+	}
+
+	var urls []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
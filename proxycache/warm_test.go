@@ -0,0 +1,104 @@
+package proxycache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadWarmList(t *testing.T) {
+	t.Run("plain list", func(t *testing.T) {
+		urls, err := ReadWarmList(strings.NewReader("# comment\n/home\n\n  https://example.com/products/1  \n"))
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/home", "https://example.com/products/1"}, urls)
+	})
+
+	t.Run("sitemap", func(t *testing.T) {
+		urls, err := ReadWarmList(strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://example.com/</loc><lastmod>2025-01-01</lastmod></url>
+  <url><loc> https://example.com/products/1 </loc></url>
+</urlset>`))
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"https://example.com/", "https://example.com/products/1"}, urls)
+	})
+
+	t.Run("sitemap index is not supported", func(t *testing.T) {
+		_, err := ReadWarmList(strings.NewReader(`<sitemapindex><sitemap><loc>https://example.com/sitemap1.xml</loc></sitemap></sitemapindex>`))
+
+		assert.Error(t, err)
+	})
+}
+
+func TestWarmer(t *testing.T) {
+	server := createTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer server.Close()
+	cache := NewInMemoryCache(10)
+	proxy := httptest.NewServer(newTestProxy(t, server.URL, WithMiddlewares(CacheMiddleware(cache))))
+	defer proxy.Close()
+	target, _ := url.Parse(proxy.URL)
+
+	var mu sync.Mutex
+	results := map[string]WarmResult{}
+	warmer := &Warmer{Concurrency: 2, Rate: 100}
+	warmer.Warm(context.Background(), target, []string{"/a", "https://example.com/b?page=2", "/missing", "/a"}, func(result WarmResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		results[result.URL] = result
+	})
+
+	require.Len(t, results, 3)
+	assert.Equal(t, http.StatusOK, results["https://example.com/b?page=2"].StatusCode)
+	assert.Equal(t, "MISS", results["https://example.com/b?page=2"].CacheStatus, "filled by the warmer")
+	assert.Equal(t, http.StatusNotFound, results["/missing"].StatusCode)
+	assert.NoError(t, results["/a"].Err)
+	keys, _ := cache.Keys()
+	assert.Len(t, keys, 3)
+	entity, _ := cache.Get(getETag(httptest.NewRequest(http.MethodGet, "/b?page=2", nil)))
+	assert.NotNil(t, entity)
+
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/a", nil)
+	request.Host = target.Host
+	proxy.Config.Handler.ServeHTTP(response, request)
+	assert.Equal(t, "HIT", response.Header().Get("X-Cache-Status"))
+}
+
+func TestWarmerRate(t *testing.T) {
+	server := createTestServer(func(w http.ResponseWriter, r *http.Request) {})
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	start := time.Now()
+	var n int
+	(&Warmer{Concurrency: 4, Rate: 50}).Warm(context.Background(), target, []string{"/1", "/2", "/3", "/4", "/5"}, func(WarmResult) { n++ })
+
+	assert.Equal(t, 5, n)
+	assert.GreaterOrEqual(t, time.Since(start), 4*20*time.Millisecond)
+}
+
+func TestWarmerHugeRate(t *testing.T) {
+	server := createTestServer(func(w http.ResponseWriter, r *http.Request) {})
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	var n int
+	assert.NotPanics(t, func() {
+		(&Warmer{Rate: 1e12}).Warm(context.Background(), target, []string{"/1", "/2"}, func(WarmResult) { n++ })
+	})
+	assert.Equal(t, 2, n)
+}